@@ -0,0 +1,73 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops calls to a failing store. After threshold consecutive
+// failures it opens for cooldown, then lets a single probe through; the
+// probe's outcome closes it or opens it again.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether the store may be called
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+
+	// Half-open: a probe that never reports back is replaced after a cooldown
+	b.probing = true
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// record reports the outcome of a store call
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.probing = false
+	}
+}
+
+// retryAfter returns how long until the breaker lets a probe through
+func (b *breaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return time.Until(b.openUntil)
+}
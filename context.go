@@ -0,0 +1,115 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Info describes the idempotency state of the request a handler is serving
+type Info struct {
+	// Key is the raw idempotency key sent by the client
+	Key string
+
+	// StoreKey is the scoped key the response is stored under
+	StoreKey string
+
+	// Fingerprint is the request fingerprint part of StoreKey.
+	// It is empty when a custom KeyFunc doesn't produce "<key>:<fingerprint>" keys.
+	Fingerprint string
+
+	// Attempt counts how many times the handler has run for StoreKey, starting at 1.
+	// Stores that don't implement AttemptCounter always report 1.
+	Attempt int
+
+	// LockHeld reports whether this request holds the lock for StoreKey
+	LockHeld bool
+
+	// LockedAt is when the lock for StoreKey was acquired
+	LockedAt time.Time
+
+	// Owner identifies the process holding the lock
+	Owner Owner
+
+	// FencingToken increases with every attempt on StoreKey. Pass it along
+	// with writes so storage can reject writes of attempts that were taken over.
+	// It is 0 when the store doesn't provide fencing tokens.
+	FencingToken uint64
+
+	control *control
+}
+
+// cacheAction is what the middleware does with the handler's response
+type cacheAction int
+
+const (
+	cacheDefault cacheAction = iota
+	cacheSkip
+	cacheRelease
+)
+
+// control holds the caching decision a handler made for its own response
+type control struct {
+	mu     sync.Mutex
+	action cacheAction
+	ttl    time.Duration
+}
+
+func (c *control) set(action cacheAction, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.action = action
+	c.ttl = ttl
+}
+
+func (c *control) get() (cacheAction, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.action, c.ttl
+}
+
+// FirstAttempt reports whether this is the first time the handler runs for the key
+func (i *Info) FirstAttempt() bool {
+	return i.Attempt <= 1
+}
+
+// DoNotCache tells Middleware not to store the response of the current request.
+// The key stays used: retries with it get 410 Gone, with the header
+// X-Idempotency-Status: not-retained, instead of a replay or a re-run.
+// It is a no-op when ctx doesn't come from Middleware.
+func DoNotCache(ctx context.Context) {
+	if info, ok := FromContext(ctx); ok {
+		info.control.set(cacheSkip, 0)
+	}
+}
+
+// ReleaseKey tells Middleware to discard the response of the current request
+// and release the key, so the client can fix the request and resubmit it with
+// the same key. It is a no-op when ctx doesn't come from Middleware.
+func ReleaseKey(ctx context.Context) {
+	if info, ok := FromContext(ctx); ok {
+		info.control.set(cacheRelease, 0)
+	}
+}
+
+// CacheFor tells Middleware to cache the response of the current request for ttl
+// instead of the configured TTL. It is a no-op when ctx doesn't come from Middleware.
+func CacheFor(ctx context.Context, ttl time.Duration) {
+	if info, ok := FromContext(ctx); ok {
+		info.control.set(cacheDefault, ttl)
+	}
+}
+
+type infoContextKey struct{}
+
+// FromContext returns the idempotency state stored in ctx by Middleware.
+// The second return value is false when the request carries no idempotency key.
+func FromContext(ctx context.Context) (*Info, bool) {
+	info, ok := ctx.Value(infoContextKey{}).(*Info)
+	return info, ok
+}
+
+// newContext returns a copy of ctx carrying info
+func newContext(ctx context.Context, info *Info) context.Context {
+	return context.WithValue(ctx, infoContextKey{}, info)
+}
@@ -11,4 +11,10 @@ var (
 
 	// ErrLockFailed is returned when acquiring a lock fails
 	ErrLockFailed = errors.New("failed to acquire lock")
+
+	// ErrNotOwner is returned when a record is owned by another process
+	ErrNotOwner = errors.New("idempotency record is owned by another process")
+
+	// ErrCircuitOpen is reported when the store isn't called because it failed repeatedly
+	ErrCircuitOpen = errors.New("idempotency store circuit breaker is open")
 )
@@ -32,10 +32,12 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/payment", handlePayment)
 
-	// Wrap with idempotency middleware
+	// Wrap with idempotency middleware, payments must carry a key
 	handler := idempotency.Middleware(
 		memStore,
 		idempotency.WithTTL(24*time.Hour),
+		idempotency.WithServeMux(mux),
+		idempotency.WithRoutePolicy("/api/payment", idempotency.WithRequireKey(true)),
 	)(mux)
 
 	fmt.Println("Server starting on :8080")
@@ -1,11 +1,14 @@
 module github.com/AnandSundar/go-idempotency
 
-go 1.21
+// Go 1.23 is the first release with http.Request.Pattern, which route
+// policies read when the middleware is wrapped by a ServeMux
+go 1.23.0
 
 require (
 	github.com/alicebob/miniredis/v2 v2.32.1
 	github.com/redis/go-redis/v9 v9.4.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.33.0
 )
 
 require (
@@ -5,10 +5,16 @@ package idempotency
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,6 +25,25 @@ const (
 	DefaultTTL = 24 * time.Hour
 )
 
+// FingerprintPart selects a part of the request included in its fingerprint
+type FingerprintPart int
+
+const (
+	// FingerprintMethod includes the HTTP method
+	FingerprintMethod FingerprintPart = 1 << iota
+	// FingerprintPath includes the URL path
+	FingerprintPath
+	// FingerprintPattern includes the ServeMux route pattern
+	FingerprintPattern
+	// FingerprintQuery includes the raw URL query
+	FingerprintQuery
+	// FingerprintBody includes the request body
+	FingerprintBody
+
+	// DefaultFingerprint is the fingerprint used when no KeyFunc is configured
+	DefaultFingerprint = FingerprintMethod | FingerprintPath | FingerprintBody
+)
+
 // Middleware returns an HTTP middleware that enforces idempotency.
 // It checks for an idempotency key in the request header, and if found,
 // either returns a cached response or processes and caches the new response.
@@ -27,11 +52,18 @@ func Middleware(store Store, opts ...Option) func(http.Handler) http.Handler {
 		HeaderName: DefaultHeaderName,
 		TTL:        DefaultTTL,
 		KeyFunc:    defaultKeyFunc,
+		Lease:      DefaultLease,
+		Owner:      DefaultOwner(),
+
+		HeartbeatInterval: DefaultHeartbeatInterval,
 	}
 
 	for _, opt := range opts {
 		opt(config)
 	}
+	config.resolveRoutes()
+
+	records := AsRecordStore(store)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -41,8 +73,24 @@ func Middleware(store Store, opts ...Option) func(http.Handler) http.Handler {
 				return
 			}
 
+			// Pick the route policy, exposing the pattern to the KeyFunc
+			pattern := config.routePattern(r)
+			if r.Pattern != pattern {
+				r = r.WithContext(r.Context())
+				r.Pattern = pattern
+			}
+			if !config.enforced(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			config := config.forRequest(r)
+
 			key := r.Header.Get(config.HeaderName)
 			if key == "" {
+				if config.RequireKey {
+					http.Error(w, "Idempotency key required", http.StatusBadRequest)
+					return
+				}
 				// No idempotency key, process normally
 				next.ServeHTTP(w, r)
 				return
@@ -55,26 +103,78 @@ func Middleware(store Store, opts ...Option) func(http.Handler) http.Handler {
 				return
 			}
 
-			// Try to acquire lock
-			unlock, err := store.Lock(fullKey)
+			// Stay away from a store that keeps failing
+			if !config.breaker.allow() {
+				config.degrade(w, r, next, ErrCircuitOpen)
+				return
+			}
+
+			// Start a record for the key, or find out what happened to it
+			rec, started, err := records.Begin(fullKey, config.Owner, config.TTL)
+			if contended(err) {
+				http.Error(w, "Request already in progress", http.StatusConflict)
+				return
+			}
+			config.breaker.record(err)
 			if err != nil {
-				if err == ErrRequestInProgress {
+				config.degrade(w, r, next, err)
+				return
+			}
+
+			// Take over a record abandoned by a dead or stuck process
+			var stale *Record
+			if !started && rec.Stale(config.Owner, config.Lease, config.LocalProcessCheck) {
+				stale = rec
+				rec, started, err = records.Takeover(fullKey, stale, config.Owner)
+				if contended(err) {
 					http.Error(w, "Request already in progress", http.StatusConflict)
 					return
 				}
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
+				config.breaker.record(err)
+				if err != nil {
+					config.degrade(w, r, next, err)
+					return
+				}
 			}
 
-			// Check if response is cached
-			cached, err := store.Get(fullKey)
-			if err == nil && cached != nil {
-				unlock()
-				// Return cached response
-				writeCachedResponse(w, cached)
+			if !started {
+				if rec.State == StateCompleted && rec.Response != nil {
+					// Return cached response
+					writeCachedResponse(w, rec.Response)
+					return
+				}
+				http.Error(w, "Request already in progress", http.StatusConflict)
 				return
 			}
 
+			// Let the application reconcile what the stale attempt left behind
+			if stale != nil && config.TakeoverHook != nil {
+				if err := config.TakeoverHook(r.Context(), stale); err != nil {
+					// Leave the record without heartbeat so reconciliation is
+					// retried once it turns stale again
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			// Expose idempotency state to the handler
+			info := &Info{
+				Key:         key,
+				StoreKey:    fullKey,
+				Fingerprint: strings.TrimPrefix(fullKey, key+":"),
+				Attempt:     rec.Attempt,
+				LockHeld:    true,
+				LockedAt:    rec.StartedAt,
+				Owner:       rec.Owner,
+				control:     &control{},
+
+				FencingToken: rec.Token,
+			}
+			if info.Fingerprint == fullKey {
+				info.Fingerprint = ""
+			}
+			r = r.WithContext(newContext(r.Context(), info))
+
 			// Capture response
 			recorder := &responseRecorder{
 				ResponseWriter: w,
@@ -82,23 +182,139 @@ func Middleware(store Store, opts ...Option) func(http.Handler) http.Handler {
 				body:           &bytes.Buffer{},
 			}
 
-			// Process request
+			// Keep the handler running after a client disconnect if configured
+			clientCtx := r.Context()
+			if config.CancelPolicy == CancelDetach {
+				ctx := context.WithoutCancel(clientCtx)
+				if deadline, ok := clientCtx.Deadline(); ok {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithDeadline(ctx, deadline)
+					defer cancel()
+				}
+				r = r.WithContext(ctx)
+			}
+
+			// Process request, keeping the record alive meanwhile
+			stopHeartbeat := heartbeat(records, fullKey, config.Owner, config.HeartbeatInterval)
+			defer func() {
+				stopHeartbeat()
+				// Release the key of a panicking handler so a retry re-runs it
+				if p := recover(); p != nil {
+					records.Fail(fullKey, rec)
+					panic(p)
+				}
+			}()
 			next.ServeHTTP(recorder, r)
+			stopHeartbeat()
+
+			// Don't cache a response that may be partial because the client went away
+			if config.CancelPolicy == CancelDiscard && (clientCtx.Err() != nil || recorder.writeErr != nil) {
+				records.Fail(fullKey, rec)
+				return
+			}
 
-			// Cache response
-			cached = &CachedResponse{
-				StatusCode: recorder.statusCode,
-				Headers:    recorder.Header().Clone(),
-				Body:       recorder.body.Bytes(),
-				Timestamp:  time.Now(),
+			// Honor the handler's caching decision
+			ttl := config.TTL
+			action, handlerTTL := info.control.get()
+			if handlerTTL > 0 {
+				ttl = handlerTTL
 			}
 
-			if err := store.Set(fullKey, cached, config.TTL); err != nil {
-				// Log error but don't fail the request
-				// Response has already been sent
+			var cached *CachedResponse
+			switch action {
+			case cacheRelease:
+				records.Fail(fullKey, rec)
+				return
+			case cacheSkip:
+				// Keep the key used without retaining the response
+				cached = notRetainedResponse()
+			default:
+				cached = &CachedResponse{
+					StatusCode: recorder.statusCode,
+					Headers:    recorder.Header().Clone(),
+					Body:       recorder.body.Bytes(),
+					Timestamp:  time.Now(),
+				}
+
+				// Strip what must never be stored; if that fails, store nothing
+				if err := redact(r, cached, config.Redactors); err != nil {
+					cached = notRetainedResponse()
+				}
 			}
 
-			unlock()
+			// Cache response and complete the record. The response has
+			// already been sent, so a failure only counts against the store.
+			err = records.Complete(fullKey, rec, cached, ttl)
+			if errors.Is(err, ErrNotOwner) || errors.Is(err, ErrNotFound) {
+				// The record was taken over meanwhile, which is no store failure
+				err = nil
+			}
+			config.breaker.record(err)
+		})
+	}
+}
+
+// degrade handles a request that can't be recorded because of err,
+// according to the failure policy
+func (c *Config) degrade(w http.ResponseWriter, r *http.Request, next http.Handler, err error) {
+	if c.OnDegrade != nil {
+		c.OnDegrade(r, DegradeEvent{Err: err, Policy: c.FailurePolicy})
+	}
+
+	switch {
+	case c.FailurePolicy == FailOpen:
+		next.ServeHTTP(w, r)
+	case errors.Is(err, ErrCircuitOpen):
+		retryAfter := int(math.Ceil(c.breaker.retryAfter().Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// contended reports whether err means another request holds the key,
+// which is no store failure
+func contended(err error) bool {
+	return errors.Is(err, ErrRequestInProgress) || errors.Is(err, ErrLockFailed)
+}
+
+// heartbeat refreshes the record of key every interval until the returned
+// function is called or the record is taken over by another owner.
+// Calling the function again is a no-op.
+func heartbeat(records RecordStore, key string, owner Owner, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := records.Heartbeat(key, owner); err == ErrNotOwner {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
 		})
 	}
 }
@@ -109,22 +325,53 @@ func isIdempotentMethod(method string) bool {
 }
 
 // defaultKeyFunc generates a unique key combining the idempotency key and request fingerprint
-func defaultKeyFunc(r *http.Request, idempotencyKey string) (string, error) {
-	// Read body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return "", err
-	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
+var defaultKeyFunc = fingerprintKeyFunc(DefaultFingerprint)
+
+// fingerprintKeyFunc returns a KeyFunc combining the idempotency key with a
+// hash of the selected request parts
+func fingerprintKeyFunc(parts FingerprintPart) KeyFunc {
+	return func(r *http.Request, idempotencyKey string) (string, error) {
+		h := sha256.New()
+		if parts&FingerprintMethod != 0 {
+			h.Write([]byte(r.Method))
+		}
+		if parts&FingerprintPath != 0 {
+			h.Write([]byte(r.URL.Path))
+		}
+		if parts&FingerprintPattern != 0 {
+			h.Write([]byte(r.Pattern))
+		}
+		if parts&FingerprintQuery != 0 {
+			h.Write([]byte(r.URL.RawQuery))
+		}
+		if parts&FingerprintBody != 0 {
+			// Read body
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return "", err
+			}
+			r.Body = io.NopCloser(bytes.NewBuffer(body))
+			h.Write(body)
+		}
+		fingerprint := fmt.Sprintf("%x", h.Sum(nil))
 
-	// Create fingerprint: method + path + body hash
-	h := sha256.New()
-	h.Write([]byte(r.Method))
-	h.Write([]byte(r.URL.Path))
-	h.Write(body)
-	fingerprint := fmt.Sprintf("%x", h.Sum(nil))
+		return fmt.Sprintf("%s:%s", idempotencyKey, fingerprint), nil
+	}
+}
 
-	return fmt.Sprintf("%s:%s", idempotencyKey, fingerprint), nil
+// notRetainedResponse is stored in place of a response that must not be replayed.
+// Its status differs from the 409 of a request in progress, so clients don't
+// retry what will never succeed.
+func notRetainedResponse() *CachedResponse {
+	return &CachedResponse{
+		StatusCode: http.StatusGone,
+		Headers: http.Header{
+			"Content-Type":         []string{"text/plain; charset=utf-8"},
+			"X-Idempotency-Status": []string{"not-retained"},
+		},
+		Body:      []byte("Request already processed, response not retained\n"),
+		Timestamp: time.Now(),
+	}
 }
 
 // writeCachedResponse writes a cached response to the response writer
@@ -144,11 +391,14 @@ func writeCachedResponse(w http.ResponseWriter, cached *CachedResponse) {
 	w.Write(cached.Body)
 }
 
-// responseRecorder captures HTTP response for caching
+// responseRecorder captures HTTP response for caching.
+// It keeps buffering after a failed client write so a detached handler
+// still produces the full response.
 type responseRecorder struct {
 	http.ResponseWriter
 	statusCode int
 	body       *bytes.Buffer
+	writeErr   error
 }
 
 func (r *responseRecorder) WriteHeader(statusCode int) {
@@ -158,5 +408,10 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 
 func (r *responseRecorder) Write(b []byte) (int, error) {
 	r.body.Write(b)
-	return r.ResponseWriter.Write(b)
+	n, err := r.ResponseWriter.Write(b)
+	if err != nil && r.writeErr == nil {
+		// Remember the first failure, the client has most likely disconnected
+		r.writeErr = err
+	}
+	return n, err
 }
@@ -2,6 +2,8 @@ package idempotency_test // Changed: external test package
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -10,6 +12,7 @@ import (
 	"github.com/AnandSundar/go-idempotency" // Import as external
 	"github.com/AnandSundar/go-idempotency/store"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMiddleware_CachesResponse(t *testing.T) {
@@ -104,3 +107,825 @@ func TestMiddleware_WithCustomTTL(t *testing.T) {
 	handler.ServeHTTP(rec2, req2)
 	assert.Empty(t, rec2.Header().Get("X-Idempotency-Cached"))
 }
+
+func TestMiddleware_CanceledRequestIsNotCached(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"partial":`))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`)).WithContext(ctx)
+	req1.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req1)
+
+	// Retry should re-run the handler
+	req2 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+	req2.Header.Set("Idempotency-Key", "test-123")
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, req2)
+
+	assert.Equal(t, 2, callCount)
+	assert.Empty(t, rec2.Header().Get("X-Idempotency-Cached"))
+}
+
+func TestMiddleware_FailedClientWriteIsNotCached(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.Write([]byte(`{"success":true}`))
+	}))
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+	req1.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(&brokenWriter{ResponseRecorder: httptest.NewRecorder()}, req1)
+
+	req2 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+	req2.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req2)
+
+	assert.Equal(t, 2, callCount)
+}
+
+func TestMiddleware_CancelDetachCachesFullResponse(t *testing.T) {
+	s := store.NewMemoryStore()
+	var handlerErr error
+	handler := idempotency.Middleware(s, idempotency.WithCancelPolicy(idempotency.CancelDetach))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerErr = r.Context().Err()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"success":true}`))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`)).WithContext(ctx)
+	req1.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(&brokenWriter{ResponseRecorder: httptest.NewRecorder()}, req1)
+
+	assert.NoError(t, handlerErr)
+
+	req2 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+	req2.Header.Set("Idempotency-Key", "test-123")
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, req2)
+
+	assert.Equal(t, http.StatusCreated, rec2.Code)
+	assert.Equal(t, `{"success":true}`, rec2.Body.String())
+	assert.Equal(t, "true", rec2.Header().Get("X-Idempotency-Cached"))
+}
+
+func TestMiddleware_CancelDetachKeepsDeadline(t *testing.T) {
+	s := store.NewMemoryStore()
+	var hasDeadline bool
+	handler := idempotency.Middleware(s, idempotency.WithCancelPolicy(idempotency.CancelDetach))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = r.Context().Deadline()
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil).WithContext(ctx)
+	req.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.True(t, hasDeadline)
+}
+
+// brokenWriter simulates a client that disconnected mid-response
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *brokenWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestMiddleware_FromContext(t *testing.T) {
+	s := store.NewMemoryStore()
+	var infos []idempotency.Info
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := idempotency.FromContext(r.Context())
+		if ok {
+			infos = append(infos, *info)
+		}
+		if len(infos) == 1 {
+			// Ask for a retry by failing the client write
+			w.Write([]byte(`{"partial":`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+	req1.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(&brokenWriter{ResponseRecorder: httptest.NewRecorder()}, req1)
+
+	req2 := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+	req2.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req2)
+
+	require.Len(t, infos, 2)
+	assert.Equal(t, "test-123", infos[0].Key)
+	assert.Equal(t, "test-123:"+infos[0].Fingerprint, infos[0].StoreKey)
+	assert.NotEmpty(t, infos[0].Fingerprint)
+	assert.True(t, infos[0].LockHeld)
+	assert.False(t, infos[0].LockedAt.IsZero())
+	assert.True(t, infos[0].FirstAttempt())
+	assert.Equal(t, 2, infos[1].Attempt)
+	assert.False(t, infos[1].FirstAttempt())
+}
+
+func TestMiddleware_FromContextWithoutKey(t *testing.T) {
+	s := store.NewMemoryStore()
+	found := true
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, found = idempotency.FromContext(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/payment", nil))
+
+	assert.False(t, found)
+}
+
+func TestMiddleware_ReleaseKey(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		idempotency.ReleaseKey(r.Context())
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewBufferString(`{"amount":100}`))
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Empty(t, rec.Header().Get("X-Idempotency-Cached"))
+	}
+
+	assert.Equal(t, 2, callCount)
+}
+
+func TestMiddleware_DoNotCache(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		idempotency.DoNotCache(r.Context())
+		w.Write([]byte(`{"secret":"s3cr3t"}`))
+	}))
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/keys", nil)
+	req1.Header.Set("Idempotency-Key", "test-123")
+	rec1 := httptest.NewRecorder()
+	handler.ServeHTTP(rec1, req1)
+	assert.Equal(t, `{"secret":"s3cr3t"}`, rec1.Body.String())
+
+	req2 := httptest.NewRequest(http.MethodPost, "/api/keys", nil)
+	req2.Header.Set("Idempotency-Key", "test-123")
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, req2)
+
+	assert.Equal(t, 1, callCount)
+	assert.Equal(t, http.StatusGone, rec2.Code)
+	assert.Equal(t, "not-retained", rec2.Header().Get("X-Idempotency-Status"))
+	assert.NotContains(t, rec2.Body.String(), "s3cr3t")
+}
+
+func TestMiddleware_CacheFor(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s, idempotency.WithTTL(time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		idempotency.CacheFor(r.Context(), 100*time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req1.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req1)
+
+	time.Sleep(150 * time.Millisecond)
+
+	req2 := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req2.Header.Set("Idempotency-Key", "test-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req2)
+
+	assert.Equal(t, 2, callCount)
+}
+
+func TestMiddleware_RoutePolicyWithServeMux(t *testing.T) {
+	s := store.NewMemoryStore()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PathValue("id")))
+	})
+	mux.HandleFunc("POST /search", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := idempotency.Middleware(s,
+		idempotency.WithServeMux(mux),
+		idempotency.WithRoutePolicy("POST /orders/{id}",
+			idempotency.WithRequireKey(true),
+			idempotency.WithFingerprint(idempotency.FingerprintPattern|idempotency.FingerprintPath),
+		),
+	)(mux)
+
+	// Key is required on the orders route only
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders/123", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/search", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Same key on different orders is scoped by path
+	for _, id := range []string{"123", "124"} {
+		req := httptest.NewRequest(http.MethodPost, "/orders/"+id, nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, id, rec.Body.String())
+		assert.Empty(t, rec.Header().Get("X-Idempotency-Cached"))
+	}
+
+	// Body is not part of the fingerprint on this route
+	req := httptest.NewRequest(http.MethodPost, "/orders/123", bytes.NewBufferString(`{"note":"changed"}`))
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "true", rec.Header().Get("X-Idempotency-Cached"))
+}
+
+func TestMiddleware_PathPolicy(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s,
+		idempotency.WithPathPolicy("/api/quotes", idempotency.WithTTL(100*time.Millisecond)),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, path := range []string{"/api/quotes", "/api/payment"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// Only the quote expired
+	for _, path := range []string{"/api/quotes", "/api/payment"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 3, callCount)
+}
+
+func TestMiddleware_IncludeExclude(t *testing.T) {
+	s := store.NewMemoryStore()
+	handler := idempotency.Middleware(s,
+		idempotency.WithInclude(idempotency.PathPrefix("/api/")),
+		idempotency.WithExclude(
+			idempotency.PathGlob("/api/webhooks/*"),
+			idempotency.MethodPattern(http.MethodPut, ""),
+			func(r *http.Request) bool { return r.Header.Get("Content-Type") == "application/octet-stream" },
+		),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		header   string
+		enforced bool
+	}{
+		{name: "included", method: http.MethodPost, path: "/api/payment", enforced: true},
+		{name: "not included", method: http.MethodPost, path: "/healthz"},
+		{name: "excluded by glob", method: http.MethodPost, path: "/api/webhooks/stripe"},
+		{name: "excluded by method", method: http.MethodPut, path: "/api/payment"},
+		{name: "excluded by predicate", method: http.MethodPost, path: "/api/upload", header: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(tt.method, tt.path, nil)
+				req.Header.Set("Idempotency-Key", "test-"+tt.name)
+				if tt.header != "" {
+					req.Header.Set("Content-Type", tt.header)
+				}
+				rec = httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+			}
+
+			assert.Equal(t, tt.enforced, rec.Header().Get("X-Idempotency-Cached") == "true")
+		})
+	}
+}
+
+func TestMiddleware_Bypass(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req = req.WithContext(idempotency.Bypass(req.Context()))
+		req.Header.Set("Idempotency-Key", "test-123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 2, callCount)
+}
+
+// legacyStore hides the RecordStore methods of the wrapped store
+type legacyStore struct {
+	idempotency.Store
+	idempotency.AttemptCounter
+}
+
+func TestMiddleware_LegacyStore(t *testing.T) {
+	m := store.NewMemoryStore()
+	s := legacyStore{Store: m, AttemptCounter: m}
+	callCount := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		info, _ := idempotency.FromContext(r.Context())
+		if info.FirstAttempt() {
+			idempotency.ReleaseKey(r.Context())
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+
+	assert.Equal(t, 2, callCount)
+}
+
+func TestMiddleware_InProgress(t *testing.T) {
+	s := store.NewMemoryStore()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	close(release)
+	<-done
+}
+
+func rawKeyFunc(r *http.Request, key string) (string, error) {
+	return key, nil
+}
+
+func TestMiddleware_TakesOverRecordOfDeadOwner(t *testing.T) {
+	s := store.NewMemoryStore()
+	self := idempotency.DefaultOwner()
+
+	// Same instance and PID but an earlier process start: the process restarted
+	dead := self
+	dead.StartedAt = self.StartedAt.Add(-time.Hour)
+	_, _, err := s.Begin("test-123", dead, time.Hour)
+	require.NoError(t, err)
+
+	var reconciled *idempotency.Record
+	var info *idempotency.Info
+	handler := idempotency.Middleware(s,
+		idempotency.WithKeyFunc(rawKeyFunc),
+		idempotency.WithLocalProcessCheck(true),
+		idempotency.WithTakeoverHook(func(ctx context.Context, stale *idempotency.Record) error {
+			reconciled = stale
+			return nil
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, _ = idempotency.FromContext(r.Context())
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	require.NotNil(t, reconciled)
+	assert.True(t, reconciled.Owner.Equal(dead))
+	require.NotNil(t, info)
+	assert.Equal(t, 2, info.Attempt)
+	assert.Equal(t, uint64(2), info.FencingToken)
+	assert.True(t, info.Owner.Equal(self))
+}
+
+func TestMiddleware_KeepsRecordOfProcessSharingInstance(t *testing.T) {
+	s := store.NewMemoryStore()
+	self := idempotency.DefaultOwner()
+
+	// Containers sharing a hostname, each running as PID 1 in its own namespace
+	self.PID = 1
+	sibling := self
+	sibling.StartedAt = self.StartedAt.Add(-time.Hour)
+	sibling.Nonce = "sibling"
+	_, _, err := s.Begin("test-123", sibling, time.Hour)
+	require.NoError(t, err)
+
+	callCount := 0
+	handler := idempotency.Middleware(s,
+		idempotency.WithKeyFunc(rawKeyFunc),
+		idempotency.WithOwner(self),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, 0, callCount)
+}
+
+func TestMiddleware_TakesOverRecordWithExpiredHeartbeat(t *testing.T) {
+	s := store.NewMemoryStore()
+	remote := idempotency.Owner{Instance: "other-host", PID: 1, StartedAt: time.Now()}
+	_, _, err := s.Begin("test-123", remote, time.Hour)
+	require.NoError(t, err)
+
+	callCount := 0
+	handler := idempotency.Middleware(s,
+		idempotency.WithKeyFunc(rawKeyFunc),
+		idempotency.WithLease(100*time.Millisecond),
+		idempotency.WithTakeoverHook(func(ctx context.Context, stale *idempotency.Record) error {
+			return errors.New("reconcile failed")
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	// Owner on another host with a fresh heartbeat is alive
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	time.Sleep(150 * time.Millisecond)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// Failed reconciliation blocks the key until it is stale again
+	req = httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, 0, callCount)
+
+	time.Sleep(150 * time.Millisecond)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, 0, callCount)
+}
+
+func TestMiddleware_HeartbeatKeepsRecordAlive(t *testing.T) {
+	s := store.NewMemoryStore()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := idempotency.Middleware(s,
+		idempotency.WithKeyFunc(rawKeyFunc),
+		idempotency.WithLease(100*time.Millisecond),
+		idempotency.WithHeartbeatInterval(20*time.Millisecond),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	time.Sleep(200 * time.Millisecond)
+
+	// A long running request with a live heartbeat is not taken over
+	other := idempotency.Owner{Instance: "other-host", PID: 1, StartedAt: time.Now()}
+	rec, started2, err := s.Begin("test-123", other, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started2)
+	assert.False(t, rec.Stale(other, 100*time.Millisecond, true))
+
+	close(release)
+	<-done
+}
+
+func TestMiddleware_PanicReleasesKey(t *testing.T) {
+	s := store.NewMemoryStore()
+	callCount := 0
+	handler := idempotency.Middleware(s,
+		idempotency.WithHeartbeatInterval(10*time.Millisecond),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if callCount == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	assert.PanicsWithValue(t, "handler failed", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	// The retry re-runs the handler instead of waiting for the lease
+	req = httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 2, callCount)
+}
+
+func TestMiddleware_StoreUnavailable(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultScript(store.OpBegin, store.Fault{Err: store.ErrInjected}),
+	)
+
+	calls := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, 0, calls)
+
+	// The store recovered
+	req = httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, calls)
+}
+
+func TestMiddleware_LockTimeout(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultScript(store.OpBegin, store.LockTimeout(10*time.Millisecond)),
+	)
+
+	calls := 0
+	handler := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+	req.Header.Set("Idempotency-Key", "test-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, 0, calls)
+}
+
+func TestMiddleware_ContendedBegin(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultRate(store.OpBegin, 1, store.Fault{Err: idempotency.ErrLockFailed}),
+	)
+
+	var events []idempotency.DegradeEvent
+	handler := idempotency.Middleware(s,
+		idempotency.WithCircuitBreaker(1, time.Minute),
+		idempotency.WithDegradeHook(func(r *http.Request, event idempotency.DegradeEvent) {
+			events = append(events, event)
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Contention is reported as a conflict and doesn't trip the breaker
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	}
+	assert.Equal(t, 3, s.Calls(store.OpBegin))
+	assert.Empty(t, events)
+}
+
+func TestMiddleware_LostCompletion(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultScript(store.OpComplete, store.Fault{Drop: true}),
+	)
+
+	calls := 0
+	handler := idempotency.Middleware(s,
+		idempotency.WithLease(50*time.Millisecond),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, serve())
+
+	// The record looks in progress until its heartbeat expires
+	assert.Equal(t, http.StatusConflict, serve())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusCreated, serve())
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 2, s.Calls(store.OpComplete))
+}
+
+func TestMiddleware_FailOpen(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultRate(store.OpBegin, 1, store.Fault{Err: store.ErrInjected}),
+	)
+
+	var events []idempotency.DegradeEvent
+	handler := idempotency.Middleware(s,
+		idempotency.WithFailurePolicy(idempotency.FailOpen),
+		idempotency.WithPathPolicy("/api/payment", idempotency.WithFailurePolicy(idempotency.FailClosed)),
+		idempotency.WithDegradeHook(func(r *http.Request, event idempotency.DegradeEvent) {
+			events = append(events, event)
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := idempotency.FromContext(r.Context())
+		assert.False(t, ok)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	serve := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Processed without idempotency
+	assert.Equal(t, http.StatusCreated, serve("/api/comments"))
+	// Payments are refused
+	assert.Equal(t, http.StatusInternalServerError, serve("/api/payment"))
+
+	require.Len(t, events, 2)
+	assert.ErrorIs(t, events[0].Err, store.ErrInjected)
+	assert.Equal(t, idempotency.FailOpen, events[0].Policy)
+	assert.Equal(t, idempotency.FailClosed, events[1].Policy)
+}
+
+func TestMiddleware_CircuitBreaker(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultScript(store.OpBegin,
+			store.Fault{Err: store.ErrInjected},
+			store.Fault{Err: store.ErrInjected},
+		),
+	)
+
+	var events []idempotency.DegradeEvent
+	handler := idempotency.Middleware(s,
+		idempotency.WithCircuitBreaker(2, 100*time.Millisecond),
+		idempotency.WithDegradeHook(func(r *http.Request, event idempotency.DegradeEvent) {
+			events = append(events, event)
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, serve().Code)
+	assert.Equal(t, http.StatusInternalServerError, serve().Code)
+
+	// The breaker is open, the store isn't called anymore
+	rec := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, 2, s.Calls(store.OpBegin))
+	require.Len(t, events, 3)
+	assert.ErrorIs(t, events[2].Err, idempotency.ErrCircuitOpen)
+
+	// After the cooldown a probe finds the store healthy again
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusCreated, serve().Code)
+	assert.Equal(t, http.StatusCreated, serve().Code)
+	assert.Equal(t, 4, s.Calls(store.OpBegin))
+}
+
+func TestMiddleware_CircuitBreakerStuckProbe(t *testing.T) {
+	s := store.NewFaultStore(store.NewMemoryStore(),
+		store.WithFaultScript(store.OpBegin,
+			store.Fault{Err: store.ErrInjected},
+			store.Fault{Latency: time.Second},
+		),
+	)
+
+	handler := idempotency.Middleware(s,
+		idempotency.WithCircuitBreaker(1, 50*time.Millisecond),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	serve := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/payment", nil)
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, serve("key-1"))
+
+	// The probe hangs in the store
+	time.Sleep(60 * time.Millisecond)
+	go serve("key-2")
+
+	// Once another cooldown passed without word from it, a new probe goes through
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusCreated, serve("key-3"))
+	assert.Equal(t, 3, s.Calls(store.OpBegin))
+}
@@ -1,6 +1,7 @@
 package idempotency
 
 import (
+	"context"
 	"net/http"
 	"time"
 )
@@ -10,11 +11,106 @@ type Config struct {
 	HeaderName string
 	TTL        time.Duration
 	KeyFunc    KeyFunc
+
+	// Lease is how long a request in progress blocks its key without a heartbeat.
+	// After that, or once its owner is provably dead, another request takes it over.
+	Lease time.Duration
+
+	// LocalProcessCheck takes over records whose owner ran on this instance
+	// and isn't running anymore, without waiting for the lease
+	LocalProcessCheck bool
+
+	// HeartbeatInterval is how often a request in progress refreshes its record
+	HeartbeatInterval time.Duration
+
+	// Owner identifies this process in the records it starts
+	Owner Owner
+
+	// Redactors rewrite recorded responses before they are stored
+	Redactors []Redactor
+
+	// TakeoverHook runs after a stale record was taken over and before the
+	// handler re-runs, so the application can reconcile partial work
+	TakeoverHook TakeoverHook
+
+	// CancelPolicy decides what to do with the response when the client
+	// goes away before the handler finishes, CancelDiscard by default
+	CancelPolicy CancelPolicy
+
+	// RequireKey rejects requests without an idempotency key
+	RequireKey bool
+
+	// FailurePolicy decides what to do with requests when the store fails
+	FailurePolicy FailurePolicy
+
+	// OnDegrade is called for every request handled under FailurePolicy
+	OnDegrade DegradeHook
+
+	// Mux resolves the route pattern of requests when the middleware wraps
+	// a whole ServeMux, so route policies can match before the mux runs
+	Mux *http.ServeMux
+
+	// Include limits the middleware to requests matching any of the matchers.
+	// Empty means all requests.
+	Include []Matcher
+
+	// Exclude passes requests matching any of the matchers straight to the handler
+	Exclude []Matcher
+
+	routes  []*route
+	breaker *breaker
 }
 
 // KeyFunc generates a unique key from the request and idempotency key
 type KeyFunc func(r *http.Request, idempotencyKey string) (string, error)
 
+// TakeoverHook reconciles the partial work of a stale record before the request
+// is re-run. Returning an error fails the request with 500 Internal Server Error.
+type TakeoverHook func(ctx context.Context, stale *Record) error
+
+// CancelPolicy controls how the middleware treats requests whose client
+// disconnected or whose context was canceled mid-request
+type CancelPolicy int
+
+const (
+	// CancelDiscard drops the response of a canceled request without caching it,
+	// so a retry with the same key re-runs the handler. It trades duplicate
+	// execution for freshness: side effects the handler completed before the
+	// client went away are performed again by the retry. It is the default.
+	CancelDiscard CancelPolicy = iota
+
+	// CancelDetach runs the handler with a context that is not canceled when the
+	// client goes away, and caches the full response once the handler returns.
+	// The deadline of the request context still applies.
+	CancelDetach
+)
+
+// FailurePolicy controls how the middleware treats requests it can't record
+// because the store failed or its circuit breaker is open
+type FailurePolicy int
+
+const (
+	// FailClosed refuses the request with 500 Internal Server Error, or with
+	// 503 Service Unavailable and Retry-After while the circuit breaker is open
+	FailClosed FailurePolicy = iota
+
+	// FailOpen runs the handler without idempotency protection
+	FailOpen
+)
+
+// DegradeEvent describes a request handled under the failure policy
+type DegradeEvent struct {
+	// Err is the store error, or ErrCircuitOpen if the store wasn't called
+	Err error
+
+	// Policy is the failure policy applied to the request
+	Policy FailurePolicy
+}
+
+// DegradeHook observes requests handled under the failure policy, e.g. to
+// count them in a metric. It must not write to the response.
+type DegradeHook func(r *http.Request, event DegradeEvent)
+
 // Option is a functional option for configuring the middleware
 type Option func(*Config)
 
@@ -32,9 +128,154 @@ func WithTTL(ttl time.Duration) Option {
 	}
 }
 
+// WithLease sets how long a request in progress blocks its key before
+// another request may process it
+func WithLease(lease time.Duration) Option {
+	return func(c *Config) {
+		c.Lease = lease
+	}
+}
+
+// WithLocalProcessCheck takes over the records of dead processes on the same
+// instance without waiting for the lease. Only enable it when Owner.Instance
+// names a single PID namespace, like a host without containers: processes
+// of other containers sharing the hostname would be reported dead.
+func WithLocalProcessCheck(enabled bool) Option {
+	return func(c *Config) {
+		c.LocalProcessCheck = enabled
+	}
+}
+
+// WithHeartbeatInterval sets how often a request in progress refreshes its record
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.HeartbeatInterval = interval
+	}
+}
+
+// WithOwner sets the identity of this process in the records it starts
+func WithOwner(owner Owner) Option {
+	return func(c *Config) {
+		c.Owner = owner
+	}
+}
+
+// WithTakeoverHook sets the hook reconciling the work of stale records before they are re-run
+func WithTakeoverHook(hook TakeoverHook) Option {
+	return func(c *Config) {
+		c.TakeoverHook = hook
+	}
+}
+
 // WithKeyFunc sets a custom key generation function
 func WithKeyFunc(fn KeyFunc) Option {
 	return func(c *Config) {
 		c.KeyFunc = fn
 	}
 }
+
+// WithRequireKey rejects requests without an idempotency key with 400 Bad Request
+func WithRequireKey(require bool) Option {
+	return func(c *Config) {
+		c.RequireKey = require
+	}
+}
+
+// WithFingerprint sets which parts of the request make up its fingerprint.
+// It replaces any KeyFunc set before it.
+func WithFingerprint(parts FingerprintPart) Option {
+	return func(c *Config) {
+		c.KeyFunc = fingerprintKeyFunc(parts)
+	}
+}
+
+// WithServeMux sets the mux used to resolve route patterns for route policies.
+// It is needed when the middleware wraps the mux instead of being wrapped by it,
+// since Request.Pattern is only set once the mux has routed the request.
+func WithServeMux(mux *http.ServeMux) Option {
+	return func(c *Config) {
+		c.Mux = mux
+	}
+}
+
+// WithRoutePolicy applies opts on top of the middleware configuration for
+// requests routed to the given ServeMux pattern, e.g. "POST /orders/{id}"
+func WithRoutePolicy(pattern string, opts ...Option) Option {
+	return func(c *Config) {
+		c.routes = append(c.routes, &route{match: RoutePattern(pattern), opts: opts})
+	}
+}
+
+// WithPathPolicy applies opts on top of the middleware configuration for
+// requests whose URL path starts with prefix
+func WithPathPolicy(prefix string, opts ...Option) Option {
+	return func(c *Config) {
+		c.routes = append(c.routes, &route{match: PathPrefix(prefix), opts: opts})
+	}
+}
+
+// WithMatcherPolicy applies opts on top of the middleware configuration for
+// requests selected by match
+func WithMatcherPolicy(match Matcher, opts ...Option) Option {
+	return func(c *Config) {
+		c.routes = append(c.routes, &route{match: match, opts: opts})
+	}
+}
+
+// WithInclude limits the middleware to requests matching any of the matchers
+func WithInclude(matchers ...Matcher) Option {
+	return func(c *Config) {
+		c.Include = append(c.Include, matchers...)
+	}
+}
+
+// WithExclude passes requests matching any of the matchers straight to the
+// handler, e.g. health checks, provider webhooks or streaming uploads
+func WithExclude(matchers ...Matcher) Option {
+	return func(c *Config) {
+		c.Exclude = append(c.Exclude, matchers...)
+	}
+}
+
+// WithRedactor adds redactors that rewrite recorded responses before they are
+// stored. Clients get the original response, replays get the redacted one.
+func WithRedactor(redactors ...Redactor) Option {
+	return func(c *Config) {
+		c.Redactors = append(c.Redactors, redactors...)
+	}
+}
+
+// WithCancelPolicy sets how canceled requests and client disconnects are handled
+func WithCancelPolicy(policy CancelPolicy) Option {
+	return func(c *Config) {
+		c.CancelPolicy = policy
+	}
+}
+
+// WithFailurePolicy sets how requests are handled when the store fails,
+// FailClosed by default
+func WithFailurePolicy(policy FailurePolicy) Option {
+	return func(c *Config) {
+		c.FailurePolicy = policy
+	}
+}
+
+// WithDegradeHook sets a hook called for every request handled under the failure policy
+func WithDegradeHook(hook DegradeHook) Option {
+	return func(c *Config) {
+		c.OnDegrade = hook
+	}
+}
+
+// WithCircuitBreaker stops calling the store for cooldown after threshold
+// consecutive store failures, applying the failure policy meanwhile. Once
+// the cooldown is over a single request probes the store. Routes share the
+// breaker unless they configure their own.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *Config) {
+		if threshold < 1 {
+			threshold = 1
+		}
+		c.breaker = &breaker{threshold: threshold, cooldown: cooldown}
+	}
+}
@@ -0,0 +1,77 @@
+package idempotency
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// processStart approximates the start time of the current process
+	processStart = time.Now()
+	// processNonce tells apart processes sharing a hostname and PID, like
+	// containers in separate PID namespaces
+	processNonce = newNonce()
+)
+
+// newNonce returns 16 random bytes in hex
+func newNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Owner identifies the process that started a record
+type Owner struct {
+	// Instance names the host or container, the hostname by default
+	Instance string `json:"instance"`
+	// PID is the process ID on Instance
+	PID int `json:"pid"`
+	// StartedAt is when the process started, telling apart processes that reuse a PID
+	StartedAt time.Time `json:"started_at"`
+	// Nonce is random per process, telling apart processes whose Instance
+	// and PID collide
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// DefaultOwner returns the identity of the current process
+func DefaultOwner() Owner {
+	hostname, _ := os.Hostname()
+	return Owner{
+		Instance:  hostname,
+		PID:       os.Getpid(),
+		StartedAt: processStart,
+		Nonce:     processNonce,
+	}
+}
+
+// Equal reports whether o and other identify the same process
+func (o Owner) Equal(other Owner) bool {
+	return o.Instance == other.Instance && o.PID == other.PID && o.StartedAt.Equal(other.StartedAt) &&
+		o.Nonce == other.Nonce
+}
+
+// String returns the owner as "instance/pid@start"
+func (o Owner) String() string {
+	return fmt.Sprintf("%s/%d@%s", o.Instance, o.PID, o.StartedAt.Format(time.RFC3339))
+}
+
+// provablyDead reports whether the process o is known not to be running
+// anymore, as seen from the process self. Owners on other instances can't be
+// checked and are never reported dead.
+//
+// The check trusts Instance to name a single PID namespace, which doesn't
+// hold for containers sharing a hostname, so it only runs when enabled with
+// WithLocalProcessCheck.
+func (o Owner) provablyDead(self Owner) bool {
+	if o.Instance != self.Instance {
+		return false
+	}
+	if o.PID == self.PID {
+		// Same PID but another start time means the process was restarted
+		return !o.StartedAt.Equal(self.StartedAt)
+	}
+	return !processAlive(o.PID)
+}
@@ -0,0 +1,224 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLease is the default time a started record without heartbeat blocks its key
+	DefaultLease = 30 * time.Second
+	// DefaultHeartbeatInterval is the default interval between heartbeats of a started record
+	DefaultHeartbeatInterval = 10 * time.Second
+)
+
+// RecordState is the processing state of an idempotency record
+type RecordState string
+
+const (
+	// StateStarted means a request holding the key is being processed
+	StateStarted RecordState = "started"
+	// StateCompleted means the response is stored and will be replayed
+	StateCompleted RecordState = "completed"
+	// StateFailed means processing was abandoned and the next request re-runs it
+	StateFailed RecordState = "failed"
+)
+
+// Record tracks the processing of requests under one store key
+type Record struct {
+	Key         string          `json:"key"`
+	State       RecordState     `json:"state"`
+	Response    *CachedResponse `json:"response,omitempty"`
+	Attempt     int             `json:"attempt"`
+	Token       uint64          `json:"token"`
+	Owner       Owner           `json:"owner"`
+	StartedAt   time.Time       `json:"started_at"`
+	HeartbeatAt time.Time       `json:"heartbeat_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Stale reports whether a started record has been abandoned: its heartbeat is
+// older than lease, or, with checkLocal, its owner runs on the instance of
+// self and is provably dead
+func (rec *Record) Stale(self Owner, lease time.Duration, checkLocal bool) bool {
+	if rec.State != StateStarted {
+		return false
+	}
+
+	heartbeat := rec.HeartbeatAt
+	if heartbeat.IsZero() {
+		heartbeat = rec.StartedAt
+	}
+	if !heartbeat.IsZero() && time.Since(heartbeat) > lease {
+		return true
+	}
+	return checkLocal && rec.Owner.PID != 0 && rec.Owner.provablyDead(self)
+}
+
+// RecordStore is a store built around idempotency records. Unlike Store it
+// keeps a durable trace of requests that are in progress.
+//
+// Every started attempt carries a fencing token in Record.Token, greater than
+// the token of any earlier attempt on the same key while its record is retained.
+// Writes made on behalf of an attempt can carry the token so downstream
+// systems reject writes from attempts that have since been taken over.
+type RecordStore interface {
+	// Begin atomically creates a started record for key owned by owner, or
+	// returns the current one. A failed record is replaced by a started one
+	// with the next Attempt. started reports whether this call started the
+	// record and so owns the key. The record is kept for ttl.
+	Begin(key string, owner Owner, ttl time.Duration) (rec *Record, started bool, err error)
+
+	// Heartbeat refreshes the heartbeat of a started record.
+	// It returns ErrNotOwner once the record belongs to someone else.
+	Heartbeat(key string, owner Owner) error
+
+	// Takeover atomically replaces the stale started record with a new attempt
+	// owned by owner. It fails, returning the current record, if the record
+	// changed since stale was read.
+	Takeover(key string, stale *Record, owner Owner) (rec *Record, started bool, err error)
+
+	// Complete stores the response and marks the record completed for ttl.
+	// rec is the record started by Begin or Takeover. Complete returns
+	// ErrNotOwner once the record belongs to another attempt, so an attempt
+	// that was taken over can't overwrite the response of its successor.
+	// Completing the same attempt again succeeds.
+	Complete(key string, rec *Record, response *CachedResponse, ttl time.Duration) error
+
+	// Fail marks the started record rec failed so the next Begin re-runs the
+	// request. It returns ErrNotOwner once the record belongs to another attempt.
+	Fail(key string, rec *Record) error
+}
+
+// AsRecordStore returns s itself if it implements RecordStore, and otherwise
+// wraps its Lock, Get and Set methods in an adapter implementing RecordStore
+func AsRecordStore(s Store) RecordStore {
+	if rs, ok := s.(RecordStore); ok {
+		return rs
+	}
+	return &storeAdapter{
+		store: s,
+		held:  make(map[string]heldLock),
+	}
+}
+
+// storeAdapter implements RecordStore on top of a legacy Store. Started
+// records only live as locks in the underlying store, and the lease is left
+// to the store's own lock expiry.
+//
+// Attempts are told apart by their fencing token, so with stores that
+// aren't FencedLockers an attempt whose lock expired may still complete
+// or release the key of its successor in the same process.
+type storeAdapter struct {
+	store Store
+	mu    sync.Mutex
+	held  map[string]heldLock
+}
+
+// heldLock is the lock held by the started attempt of a key
+type heldLock struct {
+	unlock func()
+	token  uint64
+}
+
+// Begin acquires the key's lock, or returns the cached response if any
+func (a *storeAdapter) Begin(key string, owner Owner, ttl time.Duration) (*Record, bool, error) {
+	unlock, token, err := a.lock(key)
+	if err == ErrRequestInProgress {
+		return &Record{Key: key, State: StateStarted}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	cached, err := a.store.Get(key)
+	if err == nil && cached != nil {
+		unlock()
+		return &Record{
+			Key:       key,
+			State:     StateCompleted,
+			Response:  cached,
+			UpdatedAt: cached.Timestamp,
+		}, false, nil
+	}
+
+	now := time.Now()
+	rec := &Record{
+		Key:         key,
+		State:       StateStarted,
+		Attempt:     1,
+		Token:       token,
+		Owner:       owner,
+		StartedAt:   now,
+		HeartbeatAt: now,
+		UpdatedAt:   now,
+	}
+	if counter, ok := a.store.(AttemptCounter); ok {
+		if attempt, err := counter.IncrAttempt(key, ttl); err == nil {
+			rec.Attempt = attempt
+		}
+	}
+
+	a.mu.Lock()
+	a.held[key] = heldLock{unlock: unlock, token: token}
+	a.mu.Unlock()
+
+	return rec, true, nil
+}
+
+// lock acquires the key's lock, with a fencing token if the store supports it
+func (a *storeAdapter) lock(key string) (func(), uint64, error) {
+	if locker, ok := a.store.(FencedLocker); ok {
+		return locker.LockFenced(key)
+	}
+	unlock, err := a.store.Lock(key)
+	return unlock, 0, err
+}
+
+// Heartbeat is a no-op, the lock expiry is left to the underlying store
+func (a *storeAdapter) Heartbeat(key string, owner Owner) error {
+	return nil
+}
+
+// Takeover never succeeds since locks of legacy stores carry no owner.
+// The key frees up once the underlying lock expires.
+func (a *storeAdapter) Takeover(key string, stale *Record, owner Owner) (*Record, bool, error) {
+	return stale, false, nil
+}
+
+// Complete caches the response and releases the key's lock
+func (a *storeAdapter) Complete(key string, rec *Record, response *CachedResponse, ttl time.Duration) error {
+	unlock, ok := a.release(key, rec)
+	if !ok {
+		return ErrNotOwner
+	}
+	defer unlock()
+
+	return a.store.Set(key, response, ttl)
+}
+
+// Fail releases the key's lock without caching anything
+func (a *storeAdapter) Fail(key string, rec *Record) error {
+	unlock, ok := a.release(key, rec)
+	if !ok {
+		return ErrNotOwner
+	}
+	unlock()
+
+	return nil
+}
+
+// release forgets the lock held by the attempt rec and returns its unlock
+// function, or reports false if the attempt doesn't hold the key's lock
+func (a *storeAdapter) release(key string, rec *Record) (func(), bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	held, ok := a.held[key]
+	if !ok || held.token != rec.Token {
+		return nil, false
+	}
+	delete(a.held, key)
+
+	return held.unlock, true
+}
@@ -0,0 +1,117 @@
+package idempotency
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RedactedValue replaces JSON fields masked by RedactJSONFields
+const RedactedValue = "[REDACTED]"
+
+// Redactor rewrites a recorded response before it is stored, e.g. to strip
+// one-time secrets. When it returns an error nothing of the response is
+// stored and replays get 410 Gone, as with DoNotCache.
+type Redactor func(r *http.Request, response *CachedResponse) error
+
+// redact applies the redactors to response in order
+func redact(r *http.Request, response *CachedResponse, redactors []Redactor) error {
+	if len(redactors) == 0 {
+		return nil
+	}
+
+	if response.Headers == nil {
+		response.Headers = http.Header{}
+	}
+	for _, redactor := range redactors {
+		if err := redactor(r, response); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropHeaders removes the named headers from stored responses
+func DropHeaders(names ...string) Redactor {
+	return func(r *http.Request, response *CachedResponse) error {
+		for _, name := range names {
+			response.Headers.Del(name)
+		}
+		return nil
+	}
+}
+
+// ReplaceBody stores body with the given content type instead of the recorded body
+func ReplaceBody(body []byte, contentType string) Redactor {
+	return func(r *http.Request, response *CachedResponse) error {
+		response.Body = body
+		response.Headers.Set("Content-Type", contentType)
+		response.Headers.Del("Content-Length")
+		return nil
+	}
+}
+
+// RedactJSONFields masks JSON fields of stored response bodies with
+// RedactedValue. Paths are dot-separated field names, where "*" matches every
+// field of an object or element of an array, e.g. "api_key" or
+// "data.*.secret". Non-empty bodies that aren't JSON fail redaction.
+func RedactJSONFields(paths ...string) Redactor {
+	split := make([][]string, len(paths))
+	for i, path := range paths {
+		split[i] = strings.Split(path, ".")
+	}
+
+	return func(r *http.Request, response *CachedResponse) error {
+		if len(bytes.TrimSpace(response.Body)) == 0 {
+			return nil
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(response.Body))
+		decoder.UseNumber()
+
+		var doc interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return err
+		}
+
+		for _, path := range split {
+			doc = maskJSON(doc, path)
+		}
+
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		response.Body = body
+		response.Headers.Del("Content-Length")
+
+		return nil
+	}
+}
+
+// maskJSON replaces the values at path in doc with RedactedValue
+func maskJSON(doc interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return RedactedValue
+	}
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if path[0] == "*" || path[0] == name {
+				v[name] = maskJSON(field, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, elem := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				v[i] = maskJSON(elem, path[1:])
+			}
+		}
+	}
+
+	return doc
+}
@@ -0,0 +1,111 @@
+package idempotency_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactJSONFields(t *testing.T) {
+	redactor := idempotency.RedactJSONFields("api_key", "data.*.secret", "items.0")
+	response := &idempotency.CachedResponse{
+		Headers: http.Header{"Content-Length": []string{"100"}},
+		Body:    []byte(`{"api_key":"sk_live_123","id":12345678901234567890,"data":{"a":{"secret":"x","name":"a"},"b":{"secret":"y"}},"items":[1,2]}`),
+	}
+
+	require.NoError(t, redactor(nil, response))
+
+	assert.JSONEq(t, `{"api_key":"[REDACTED]","id":12345678901234567890,"data":{"a":{"secret":"[REDACTED]","name":"a"},"b":{"secret":"[REDACTED]"}},"items":["[REDACTED]",2]}`, string(response.Body))
+	assert.Empty(t, response.Headers.Get("Content-Length"))
+}
+
+func TestRedactJSONFields_NotJSON(t *testing.T) {
+	redactor := idempotency.RedactJSONFields("api_key")
+
+	assert.NoError(t, redactor(nil, &idempotency.CachedResponse{}))
+	assert.Error(t, redactor(nil, &idempotency.CachedResponse{Body: []byte("api_key=123")}))
+}
+
+func TestMiddleware_Redaction(t *testing.T) {
+	s := store.NewMemoryStore()
+	handler := idempotency.Middleware(s,
+		idempotency.WithRedactor(
+			idempotency.RedactJSONFields("api_key"),
+			idempotency.DropHeaders("Set-Cookie"),
+		),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"key_1","api_key":"sk_live_123"}`))
+	}))
+
+	req1 := httptest.NewRequest(http.MethodPost, "/api/keys", nil)
+	req1.Header.Set("Idempotency-Key", "test-123")
+	rec1 := httptest.NewRecorder()
+	handler.ServeHTTP(rec1, req1)
+
+	// The client gets the secret once
+	assert.Contains(t, rec1.Body.String(), "sk_live_123")
+	assert.Equal(t, "session=abc", rec1.Header().Get("Set-Cookie"))
+
+	req2 := httptest.NewRequest(http.MethodPost, "/api/keys", nil)
+	req2.Header.Set("Idempotency-Key", "test-123")
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, req2)
+
+	assert.Equal(t, http.StatusCreated, rec2.Code)
+	assert.JSONEq(t, `{"id":"key_1","api_key":"[REDACTED]"}`, rec2.Body.String())
+	assert.Empty(t, rec2.Header().Get("Set-Cookie"))
+	assert.Equal(t, "true", rec2.Header().Get("X-Idempotency-Cached"))
+}
+
+func TestMiddleware_RedactionFailureRetainsNothing(t *testing.T) {
+	s := store.NewMemoryStore()
+	handler := idempotency.Middleware(s,
+		idempotency.WithRedactor(idempotency.RedactJSONFields("api_key")),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`api_key=sk_live_123`))
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/keys", bytes.NewBufferString(`{}`))
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if i == 1 {
+			assert.Equal(t, http.StatusGone, rec.Code)
+			assert.Equal(t, "not-retained", rec.Header().Get("X-Idempotency-Status"))
+			assert.NotContains(t, rec.Body.String(), "sk_live_123")
+		}
+	}
+}
+
+func TestMiddleware_ReplaceBody(t *testing.T) {
+	s := store.NewMemoryStore()
+	handler := idempotency.Middleware(s,
+		idempotency.WithRedactor(idempotency.ReplaceBody([]byte(`{"status":"created"}`), "application/json")),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(`one-time-secret`))
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/keys", nil)
+		req.Header.Set("Idempotency-Key", "test-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if i == 1 {
+			assert.Equal(t, `{"status":"created"}`, rec.Body.String())
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Matcher reports whether a request is selected. Request.Pattern is already
+// resolved when the middleware calls it, see WithServeMux.
+type Matcher func(r *http.Request) bool
+
+// PathPrefix matches requests whose URL path starts with prefix
+func PathPrefix(prefix string) Matcher {
+	return func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+}
+
+// PathGlob matches requests whose URL path matches a path.Match pattern, e.g. "/webhooks/*"
+func PathGlob(pattern string) Matcher {
+	return func(r *http.Request) bool {
+		ok, _ := path.Match(pattern, r.URL.Path)
+		return ok
+	}
+}
+
+// RoutePattern matches requests routed to the given ServeMux pattern
+func RoutePattern(pattern string) Matcher {
+	return func(r *http.Request) bool {
+		return r.Pattern == pattern
+	}
+}
+
+// MethodPattern matches requests with the given method routed to the given
+// ServeMux pattern. An empty method matches any method.
+func MethodPattern(method, pattern string) Matcher {
+	return func(r *http.Request) bool {
+		return (method == "" || r.Method == method) && r.Pattern == pattern
+	}
+}
+
+// matchAny reports whether any of the matchers selects the request
+func matchAny(r *http.Request, matchers []Matcher) bool {
+	for _, match := range matchers {
+		if match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+type bypassContextKey struct{}
+
+// Bypass returns a copy of ctx that makes Middleware pass the request straight
+// to the handler. It is meant for trusted internal callers and must not be
+// derived from anything the client controls.
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassContextKey{}, true)
+}
+
+// isBypassed reports whether ctx was marked with Bypass
+func isBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassContextKey{}).(bool)
+	return bypass
+}
+
+// route is a per-route policy registered with WithRoutePolicy or WithPathPolicy
+type route struct {
+	match Matcher
+	opts  []Option
+
+	// config is the middleware configuration with opts applied
+	config *Config
+}
+
+// resolveRoutes builds the configuration of each route from the base configuration.
+// Routes registered inside route options are ignored.
+func (c *Config) resolveRoutes() {
+	for _, rt := range c.routes {
+		routeConfig := *c
+		routeConfig.routes = nil
+		for _, opt := range rt.opts {
+			opt(&routeConfig)
+		}
+		routeConfig.routes = nil
+		rt.config = &routeConfig
+	}
+}
+
+// routePattern returns the ServeMux pattern the request is routed to, if known
+func (c *Config) routePattern(r *http.Request) string {
+	if r.Pattern != "" || c.Mux == nil {
+		return r.Pattern
+	}
+	_, pattern := c.Mux.Handler(r)
+	return pattern
+}
+
+// forRequest returns the configuration that applies to the request.
+// The first matching route wins; requests matching no route use c.
+func (c *Config) forRequest(r *http.Request) *Config {
+	for _, rt := range c.routes {
+		if rt.match(r) {
+			return rt.config
+		}
+	}
+	return c
+}
+
+// enforced reports whether the middleware handles the request at all
+func (c *Config) enforced(r *http.Request) bool {
+	if isBypassed(r.Context()) {
+		return false
+	}
+	if len(c.Include) > 0 && !matchAny(r, c.Include) {
+		return false
+	}
+	return !matchAny(r, c.Exclude)
+}
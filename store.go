@@ -18,10 +18,30 @@ type Store interface {
 	Lock(key string) (unlock func(), err error)
 }
 
+// AttemptCounter is an optional interface for stores that count how many
+// times a key has been processed. Middleware uses it to fill Info.Attempt.
+type AttemptCounter interface {
+	// IncrAttempt increments the attempt count for key and returns the new value.
+	// The count expires after ttl.
+	IncrAttempt(key string, ttl time.Duration) (int, error)
+}
+
+// FencedLocker is an optional interface for stores whose locks carry a fencing
+// token. Tokens of successive locks on a key increase monotonically, so a lock
+// holder that was paused past its lock expiry can be told apart by its older token.
+type FencedLocker interface {
+	// LockFenced acquires a lock like Store.Lock and returns its fencing token
+	LockFenced(key string) (unlock func(), token uint64, err error)
+}
+
 // CachedResponse represents a cached HTTP response
 type CachedResponse struct {
 	StatusCode int         `json:"status_code"`
 	Headers    http.Header `json:"headers"`
 	Body       []byte      `json:"body"`
 	Timestamp  time.Time   `json:"timestamp"`
+
+	// BodyEncoding names the compression of Body while it is at rest.
+	// Stores restore the raw body before returning a response.
+	BodyEncoding string `json:"body_encoding,omitempty"`
 }
@@ -0,0 +1,328 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// Codec serializes records for stores that keep them as bytes.
+// Every bundled codec reads the formats of all other bundled codecs, so
+// switching codecs keeps existing records readable.
+type Codec interface {
+	// Marshal encodes rec
+	Marshal(rec *idempotency.Record) ([]byte, error)
+
+	// Unmarshal decodes data written by Marshal
+	Unmarshal(data []byte) (*idempotency.Record, error)
+}
+
+// DefaultCodec is the codec stores use unless configured otherwise
+var DefaultCodec Codec = BinaryCodec{}
+
+const (
+	// binaryMagic starts records written by BinaryCodec. JSON records start
+	// with '{' instead, which tells the formats apart.
+	binaryMagic byte = 0xB1
+
+	// binaryVersion is the current BinaryCodec format version.
+	// Version 2 added the body encoding, version 3 the owner nonce.
+	binaryVersion byte = 3
+
+	// jsonVersion is the current JSONCodec format version
+	jsonVersion = 1
+)
+
+// ErrUnknownFormat is returned when stored data matches no known record format
+var ErrUnknownFormat = errors.New("unknown record format")
+
+// unmarshalRecord decodes data in any of the bundled record formats and
+// restores compressed bodies
+func unmarshalRecord(data []byte) (*idempotency.Record, error) {
+	if len(data) == 0 {
+		return nil, ErrUnknownFormat
+	}
+
+	var rec *idempotency.Record
+	var err error
+	switch data[0] {
+	case '{':
+		rec, err = unmarshalJSON(data)
+	case binaryMagic:
+		rec, err = unmarshalBinary(data)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decompressBody(rec.Response); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// JSONCodec encodes records as JSON. It is readable but base64-encodes bodies.
+type JSONCodec struct{}
+
+// jsonRecord is a record with the JSON format version
+type jsonRecord struct {
+	Version int `json:"v"`
+	*idempotency.Record
+}
+
+// Marshal encodes rec as JSON
+func (JSONCodec) Marshal(rec *idempotency.Record) ([]byte, error) {
+	return json.Marshal(jsonRecord{Version: jsonVersion, Record: rec})
+}
+
+// Unmarshal decodes a record in any bundled format
+func (JSONCodec) Unmarshal(data []byte) (*idempotency.Record, error) {
+	return unmarshalRecord(data)
+}
+
+// unmarshalJSON decodes a JSON record. Data without a state is a bare
+// CachedResponse, as written before records existed, and is read as a
+// completed record.
+func unmarshalJSON(data []byte) (*idempotency.Record, error) {
+	wrapped := jsonRecord{Record: &idempotency.Record{}}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, err
+	}
+	if wrapped.Version > jsonVersion {
+		return nil, fmt.Errorf("%w: json version %d", ErrUnknownFormat, wrapped.Version)
+	}
+	if wrapped.State != "" {
+		return wrapped.Record, nil
+	}
+
+	var response idempotency.CachedResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+
+	return &idempotency.Record{
+		State:     idempotency.StateCompleted,
+		Response:  &response,
+		StartedAt: response.Timestamp,
+		UpdatedAt: response.Timestamp,
+	}, nil
+}
+
+// BinaryCodec encodes records in a compact length-prefixed binary format
+// with raw bodies
+type BinaryCodec struct{}
+
+// Marshal encodes rec in the binary format
+func (BinaryCodec) Marshal(rec *idempotency.Record) ([]byte, error) {
+	b := []byte{binaryMagic, binaryVersion}
+	b = appendString(b, rec.Key)
+	b = appendString(b, string(rec.State))
+	b = binary.AppendUvarint(b, uint64(rec.Attempt))
+	b = binary.AppendUvarint(b, rec.Token)
+	b = appendString(b, rec.Owner.Instance)
+	b = binary.AppendVarint(b, int64(rec.Owner.PID))
+	b = appendTime(b, rec.Owner.StartedAt)
+	b = appendString(b, rec.Owner.Nonce)
+	b = appendTime(b, rec.StartedAt)
+	b = appendTime(b, rec.HeartbeatAt)
+	b = appendTime(b, rec.UpdatedAt)
+
+	if rec.Response == nil {
+		return append(b, 0), nil
+	}
+	b = append(b, 1)
+
+	resp := rec.Response
+	b = binary.AppendVarint(b, int64(resp.StatusCode))
+	b = appendTime(b, resp.Timestamp)
+	b = appendString(b, resp.BodyEncoding)
+	b = binary.AppendUvarint(b, uint64(len(resp.Headers)))
+	// Sorted so equal records always encode to the same bytes
+	names := make([]string, 0, len(resp.Headers))
+	for name := range resp.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := resp.Headers[name]
+		b = appendString(b, name)
+		b = binary.AppendUvarint(b, uint64(len(values)))
+		for _, value := range values {
+			b = appendString(b, value)
+		}
+	}
+	b = appendBytes(b, resp.Body)
+
+	return b, nil
+}
+
+// Unmarshal decodes a record in any bundled format
+func (BinaryCodec) Unmarshal(data []byte) (*idempotency.Record, error) {
+	return unmarshalRecord(data)
+}
+
+// unmarshalBinary decodes a record written by BinaryCodec
+func unmarshalBinary(data []byte) (*idempotency.Record, error) {
+	if len(data) < 2 || data[0] != binaryMagic {
+		return nil, ErrUnknownFormat
+	}
+	version := data[1]
+	if version < 1 || version > binaryVersion {
+		return nil, fmt.Errorf("%w: binary version %d", ErrUnknownFormat, version)
+	}
+
+	r := &binaryReader{data: data[2:]}
+	rec := &idempotency.Record{
+		Key:     r.string(),
+		State:   idempotency.RecordState(r.string()),
+		Attempt: int(r.uvarint()),
+		Token:   r.uvarint(),
+		Owner: idempotency.Owner{
+			Instance:  r.string(),
+			PID:       int(r.varint()),
+			StartedAt: r.time(),
+		},
+	}
+	if version >= 3 {
+		rec.Owner.Nonce = r.string()
+	}
+	rec.StartedAt = r.time()
+	rec.HeartbeatAt = r.time()
+	rec.UpdatedAt = r.time()
+
+	if r.byte() == 1 {
+		resp := &idempotency.CachedResponse{
+			StatusCode: int(r.varint()),
+			Timestamp:  r.time(),
+		}
+		if version >= 2 {
+			resp.BodyEncoding = r.string()
+		}
+		if n := r.count(); n > 0 {
+			resp.Headers = make(http.Header, n)
+			for i := 0; i < n; i++ {
+				name := r.string()
+				values := make([]string, r.count())
+				for j := range values {
+					values[j] = r.string()
+				}
+				resp.Headers[name] = values
+			}
+		}
+		resp.Body = r.bytes()
+		rec.Response = resp
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return rec, nil
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, v string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendTime appends t as Unix nanoseconds, with 0 standing for the zero time
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return binary.AppendVarint(b, 0)
+	}
+	return binary.AppendVarint(b, t.UnixNano())
+}
+
+// errTruncated is returned when binary data ends unexpectedly
+var errTruncated = errors.New("truncated binary record")
+
+// binaryReader reads the binary format, remembering the first error
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil || len(r.data) == 0 {
+		r.err = errTruncated
+		return 0
+	}
+	v := r.data[0]
+	r.data = r.data[1:]
+	return v
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads an element count, which can't exceed the remaining bytes
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = errTruncated
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errTruncated
+		return nil
+	}
+	v := make([]byte, n)
+	copy(v, r.data)
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) time() time.Time {
+	v := r.varint()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRecord() *idempotency.Record {
+	now := time.Now()
+	return &idempotency.Record{
+		Key:     "test-key",
+		State:   idempotency.StateCompleted,
+		Attempt: 2,
+		Token:   7,
+		Owner: idempotency.Owner{
+			Instance:  "host-1",
+			PID:       42,
+			StartedAt: now.Add(-time.Hour),
+			Nonce:     "0123456789abcdef",
+		},
+		StartedAt:   now.Add(-time.Second),
+		HeartbeatAt: now.Add(-time.Second),
+		UpdatedAt:   now,
+		Response: &idempotency.CachedResponse{
+			StatusCode: 201,
+			Headers: http.Header{
+				"Content-Type": []string{"application/json"},
+				"Set-Cookie":   []string{"a=1", "b=2"},
+			},
+			Body:      []byte{0x00, 0xff, '{', '}'},
+			Timestamp: now,
+		},
+	}
+}
+
+func assertSameRecord(t *testing.T, expected, actual *idempotency.Record) {
+	t.Helper()
+	assert.Equal(t, expected.Key, actual.Key)
+	assert.Equal(t, expected.State, actual.State)
+	assert.Equal(t, expected.Attempt, actual.Attempt)
+	assert.Equal(t, expected.Token, actual.Token)
+	assert.True(t, expected.Owner.Equal(actual.Owner))
+	assert.True(t, expected.StartedAt.Equal(actual.StartedAt))
+	assert.True(t, expected.HeartbeatAt.Equal(actual.HeartbeatAt))
+	assert.True(t, expected.UpdatedAt.Equal(actual.UpdatedAt))
+	require.NotNil(t, actual.Response)
+	assert.Equal(t, expected.Response.StatusCode, actual.Response.StatusCode)
+	assert.Equal(t, expected.Response.Headers, actual.Response.Headers)
+	assert.Equal(t, expected.Response.Body, actual.Response.Body)
+	assert.True(t, expected.Response.Timestamp.Equal(actual.Response.Timestamp))
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	for name, codec := range map[string]Codec{"binary": BinaryCodec{}, "json": JSONCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			rec := testRecord()
+
+			data, err := codec.Marshal(rec)
+			require.NoError(t, err)
+
+			decoded, err := codec.Unmarshal(data)
+			require.NoError(t, err)
+			assertSameRecord(t, rec, decoded)
+		})
+	}
+}
+
+func TestCodecs_ReadEachOther(t *testing.T) {
+	rec := testRecord()
+
+	jsonData, err := JSONCodec{}.Marshal(rec)
+	require.NoError(t, err)
+	decoded, err := BinaryCodec{}.Unmarshal(jsonData)
+	require.NoError(t, err)
+	assertSameRecord(t, rec, decoded)
+
+	binaryData, err := BinaryCodec{}.Marshal(rec)
+	require.NoError(t, err)
+	decoded, err = JSONCodec{}.Unmarshal(binaryData)
+	require.NoError(t, err)
+	assertSameRecord(t, rec, decoded)
+
+	// The binary format is the compact one
+	assert.Less(t, len(binaryData), len(jsonData))
+}
+
+func TestCodecs_ReadBareResponses(t *testing.T) {
+	rec, err := BinaryCodec{}.Unmarshal([]byte(`{"status_code":200,"headers":null,"body":"b2s=","timestamp":"2024-01-01T00:00:00Z"}`))
+	require.NoError(t, err)
+	assert.Equal(t, idempotency.StateCompleted, rec.State)
+	assert.Equal(t, []byte("ok"), rec.Response.Body)
+}
+
+func TestCodecs_RejectUnknownFormats(t *testing.T) {
+	data, err := BinaryCodec{}.Marshal(testRecord())
+	require.NoError(t, err)
+
+	_, err = BinaryCodec{}.Unmarshal(data[:len(data)-1])
+	assert.Error(t, err)
+
+	data[1] = binaryVersion + 1
+	_, err = BinaryCodec{}.Unmarshal(data)
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	_, err = BinaryCodec{}.Unmarshal([]byte(`{"v":99,"state":"completed"}`))
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	_, err = BinaryCodec{}.Unmarshal([]byte("garbage"))
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
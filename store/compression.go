@@ -0,0 +1,148 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// Compressor compresses response bodies at rest
+type Compressor interface {
+	// Name identifies the algorithm in CachedResponse.BodyEncoding
+	Name() string
+
+	// Compress returns the compressed data
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress returns the data given to Compress
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		"gzip": GzipCompressor{},
+	}
+)
+
+// RegisterCompressor makes c available for decoding bodies stored with its name.
+// Gzip is registered by default.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// decompressBody restores the raw body of a response stored compressed
+func decompressBody(resp *idempotency.CachedResponse) error {
+	if resp == nil || resp.BodyEncoding == "" {
+		return nil
+	}
+
+	compressorsMu.RLock()
+	c, ok := compressors[resp.BodyEncoding]
+	compressorsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown body encoding %q", resp.BodyEncoding)
+	}
+
+	body, err := c.Decompress(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	resp.BodyEncoding = ""
+
+	return nil
+}
+
+// GzipCompressor compresses bodies with gzip from the standard library
+type GzipCompressor struct {
+	// Level is the gzip compression level, gzip.DefaultCompression if 0
+	Level int
+}
+
+// Name returns "gzip"
+func (GzipCompressor) Name() string {
+	return "gzip"
+}
+
+// Compress gzips data
+func (c GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress gunzips data
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// compressingCodec compresses response bodies before encoding records with
+// the wrapped codec
+type compressingCodec struct {
+	Codec
+	compressor Compressor
+	minSize    int
+}
+
+// NewCompressingCodec returns a codec compressing response bodies of at least
+// minSize bytes with c before encoding records with inner. Bodies that don't
+// shrink are stored raw. Compressed bodies are restored by every bundled codec:
+// c is registered with RegisterCompressor, which processes only reading the
+// records must do themselves.
+func NewCompressingCodec(inner Codec, c Compressor, minSize int) Codec {
+	RegisterCompressor(c)
+	return &compressingCodec{Codec: inner, compressor: c, minSize: minSize}
+}
+
+// Marshal compresses the response body and encodes rec
+func (c *compressingCodec) Marshal(rec *idempotency.Record) ([]byte, error) {
+	resp := rec.Response
+	if resp == nil || resp.BodyEncoding != "" || len(resp.Body) < c.minSize {
+		return c.Codec.Marshal(rec)
+	}
+
+	body, err := c.compressor.Compress(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) >= len(resp.Body) {
+		return c.Codec.Marshal(rec)
+	}
+
+	compressedResp := *resp
+	compressedResp.Body = body
+	compressedResp.BodyEncoding = c.compressor.Name()
+
+	compressed := *rec
+	compressed.Response = &compressedResp
+
+	return c.Codec.Marshal(&compressed)
+}
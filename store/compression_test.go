@@ -0,0 +1,130 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressingCodec_CompressesLargeBodies(t *testing.T) {
+	for name, inner := range map[string]Codec{"binary": BinaryCodec{}, "json": JSONCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			codec := NewCompressingCodec(inner, GzipCompressor{}, 1024)
+
+			rec := testRecord()
+			rec.Response.Body = bytes.Repeat([]byte(`{"item":"value"},`), 1000)
+
+			data, err := codec.Marshal(rec)
+			require.NoError(t, err)
+			assert.Less(t, len(data), len(rec.Response.Body)/10)
+			assert.Empty(t, rec.Response.BodyEncoding, "input must not be modified")
+
+			decoded, err := codec.Unmarshal(data)
+			require.NoError(t, err)
+			assert.Equal(t, rec.Response.Body, decoded.Response.Body)
+			assert.Empty(t, decoded.Response.BodyEncoding)
+
+			// Any bundled codec restores the body
+			decoded, err = BinaryCodec{}.Unmarshal(data)
+			require.NoError(t, err)
+			assert.Equal(t, rec.Response.Body, decoded.Response.Body)
+		})
+	}
+}
+
+// deflateCompressor is a compressor not registered by default
+type deflateCompressor struct{}
+
+func (deflateCompressor) Name() string {
+	return "test-deflate"
+}
+
+func (deflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(data []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+func TestCompressingCodec_CustomCompressor(t *testing.T) {
+	store, _ := setupTestRedis(t)
+	store = NewRedisStore(store.client, WithCompression(deflateCompressor{}, 1024))
+
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: bytes.Repeat([]byte("a"), 4096)}
+	require.NoError(t, store.Set("test-key", response, time.Hour))
+
+	cached, err := store.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, response.Body, cached.Body)
+	assert.Empty(t, cached.BodyEncoding)
+}
+
+func TestCompressingCodec_SkipsSmallBodies(t *testing.T) {
+	codec := NewCompressingCodec(BinaryCodec{}, GzipCompressor{}, 1024)
+	rec := testRecord()
+
+	data, err := codec.Marshal(rec)
+	require.NoError(t, err)
+
+	plain, err := BinaryCodec{}.Marshal(rec)
+	require.NoError(t, err)
+	assert.Equal(t, plain, data)
+}
+
+func TestCompressingCodec_UnknownEncoding(t *testing.T) {
+	rec := testRecord()
+	rec.Response.BodyEncoding = "zstd"
+
+	data, err := BinaryCodec{}.Marshal(rec)
+	require.NoError(t, err)
+
+	_, err = BinaryCodec{}.Unmarshal(data)
+	assert.ErrorContains(t, err, "zstd")
+}
+
+func TestBinaryCodec_ReadsVersion1(t *testing.T) {
+	now := time.Now()
+
+	// Version 1 had no body encoding
+	b := []byte{binaryMagic, 1}
+	b = appendString(b, "test-key")
+	b = appendString(b, string(idempotency.StateCompleted))
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 1)
+	b = appendString(b, "host-1")
+	b = binary.AppendVarint(b, 42)
+	b = appendTime(b, now)
+	b = appendTime(b, now)
+	b = appendTime(b, now)
+	b = appendTime(b, now)
+	b = append(b, 1)
+	b = binary.AppendVarint(b, 200)
+	b = appendTime(b, now)
+	b = binary.AppendUvarint(b, 0)
+	b = appendBytes(b, []byte("ok"))
+
+	rec, err := BinaryCodec{}.Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, "test-key", rec.Key)
+	assert.Equal(t, 200, rec.Response.StatusCode)
+	assert.Equal(t, []byte("ok"), rec.Response.Body)
+}
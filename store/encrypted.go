@@ -0,0 +1,232 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// envelopeVersion is the current format version of encrypted bodies
+const envelopeVersion byte = 1
+
+// ErrDecrypt is returned when a stored response can't be decrypted
+var ErrDecrypt = errors.New("failed to decrypt cached response")
+
+// EncryptedStore wraps a store and encrypts every cached response with
+// AES-GCM before it reaches the wrapped store. The store key is bound as
+// associated data, so a record copied to another key fails to decrypt.
+//
+// The wrapped store only sees a response whose body is the encrypted
+// envelope; status, headers and body are all inside it.
+type EncryptedStore struct {
+	inner   idempotency.Store
+	records idempotency.RecordStore
+	codec   Codec
+
+	keys      map[string]cipher.AEAD
+	currentID string
+
+	plaintextUntil time.Time
+}
+
+// NewEncryptedStore wraps inner, encrypting with the key currentID from keys.
+// keys maps key IDs to AES keys of 16, 24 or 32 bytes. Keys other than the
+// current one are only used to decrypt, so keys can be rotated by adding a
+// new key, making it current and dropping the old one once its records expired.
+//
+// Responses stored before encryption was enabled fail with ErrDecrypt, so
+// either wrap an empty store or accept them for a while with WithPlaintextUntil.
+func NewEncryptedStore(inner idempotency.Store, currentID string, keys map[string][]byte, opts ...EncryptedOption) (*EncryptedStore, error) {
+	if len(currentID) > 255 {
+		return nil, fmt.Errorf("key ID %q is longer than 255 bytes", currentID)
+	}
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current key %q not found", currentID)
+	}
+
+	s := &EncryptedStore{
+		inner:     inner,
+		records:   idempotency.AsRecordStore(inner),
+		codec:     BinaryCodec{},
+		keys:      make(map[string]cipher.AEAD, len(keys)),
+		currentID: currentID,
+	}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		s.keys[id] = aead
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+// Get retrieves and decrypts a cached response
+func (s *EncryptedStore) Get(key string) (*idempotency.CachedResponse, error) {
+	sealed, err := s.inner.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(key, sealed)
+}
+
+// Set encrypts and stores a response
+func (s *EncryptedStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
+	sealed, err := s.seal(key, response)
+	if err != nil {
+		return err
+	}
+	return s.inner.Set(key, sealed, ttl)
+}
+
+// Lock acquires a lock from the wrapped store
+func (s *EncryptedStore) Lock(key string) (func(), error) {
+	return s.inner.Lock(key)
+}
+
+// Begin starts a record in the wrapped store, decrypting a completed response
+func (s *EncryptedStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	rec, started, err := s.records.Begin(key, owner, ttl)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.openRecord(key, rec); err != nil {
+		return nil, false, err
+	}
+	return rec, started, nil
+}
+
+// Heartbeat refreshes a record in the wrapped store
+func (s *EncryptedStore) Heartbeat(key string, owner idempotency.Owner) error {
+	return s.records.Heartbeat(key, owner)
+}
+
+// Takeover takes over a record in the wrapped store, decrypting a completed response
+func (s *EncryptedStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	rec, started, err := s.records.Takeover(key, stale, owner)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.openRecord(key, rec); err != nil {
+		return nil, false, err
+	}
+	return rec, started, nil
+}
+
+// Complete encrypts the response and completes the record in the wrapped store
+func (s *EncryptedStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	sealed, err := s.seal(key, response)
+	if err != nil {
+		return err
+	}
+	return s.records.Complete(key, rec, sealed, ttl)
+}
+
+// Fail fails a record in the wrapped store
+func (s *EncryptedStore) Fail(key string, rec *idempotency.Record) error {
+	return s.records.Fail(key, rec)
+}
+
+// seal encrypts response into an envelope response:
+// version | key ID length | key ID | nonce | ciphertext
+func (s *EncryptedStore) seal(key string, response *idempotency.CachedResponse) (*idempotency.CachedResponse, error) {
+	plaintext, err := s.codec.Marshal(&idempotency.Record{
+		Key:      key,
+		State:    idempotency.StateCompleted,
+		Response: response,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aead := s.keys[s.currentID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, 2+len(s.currentID)+len(nonce)+len(plaintext)+aead.Overhead())
+	envelope = append(envelope, envelopeVersion, byte(len(s.currentID)))
+	envelope = append(envelope, s.currentID...)
+	envelope = append(envelope, nonce...)
+	envelope = aead.Seal(envelope, nonce, plaintext, []byte(key))
+
+	return &idempotency.CachedResponse{
+		Body:      envelope,
+		Timestamp: response.Timestamp,
+	}, nil
+}
+
+// open decrypts an envelope response written by seal
+func (s *EncryptedStore) open(key string, sealed *idempotency.CachedResponse) (*idempotency.CachedResponse, error) {
+	// Envelopes carry no status, so this one was stored unencrypted
+	if sealed.StatusCode != 0 && time.Now().Before(s.plaintextUntil) {
+		return sealed, nil
+	}
+
+	envelope := sealed.Body
+	if len(envelope) < 2 || envelope[0] != envelopeVersion {
+		return nil, ErrDecrypt
+	}
+
+	idLen := int(envelope[1])
+	envelope = envelope[2:]
+	if len(envelope) < idLen {
+		return nil, ErrDecrypt
+	}
+	id := string(envelope[:idLen])
+	envelope = envelope[idLen:]
+
+	aead, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrDecrypt, id)
+	}
+	if len(envelope) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	nonce, ciphertext := envelope[:aead.NonceSize()], envelope[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	rec, err := s.codec.Unmarshal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Response == nil {
+		return nil, ErrDecrypt
+	}
+
+	return rec.Response, nil
+}
+
+// openRecord decrypts the response of the record of key in place, if it has one
+func (s *EncryptedStore) openRecord(key string, rec *idempotency.Record) error {
+	if rec.Response == nil {
+		return nil
+	}
+
+	response, err := s.open(key, rec.Response)
+	if err != nil {
+		return err
+	}
+	rec.Response = response
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestEncryptedStore_SetAndGet(t *testing.T) {
+	inner := NewMemoryStore()
+	store, err := NewEncryptedStore(inner, "k1", map[string][]byte{"k1": testKey1})
+	require.NoError(t, err)
+
+	response := &idempotency.CachedResponse{
+		StatusCode: 201,
+		Headers:    http.Header{"Content-Type": []string{"application/json"}},
+		Body:       []byte(`{"card":"4242"}`),
+		Timestamp:  time.Now(),
+	}
+	require.NoError(t, store.Set("test-key", response, time.Hour))
+
+	// The wrapped store holds no plaintext
+	sealed, err := inner.Get("test-key")
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed.Body), "4242")
+	assert.Empty(t, sealed.Headers)
+
+	cached, err := store.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, 201, cached.StatusCode)
+	assert.Equal(t, "application/json", cached.Headers.Get("Content-Type"))
+	assert.Equal(t, response.Body, cached.Body)
+}
+
+func TestEncryptedStore_RecordsCantBeSwapped(t *testing.T) {
+	inner := NewMemoryStore()
+	store, err := NewEncryptedStore(inner, "k1", map[string][]byte{"k1": testKey1})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("key-a", &idempotency.CachedResponse{StatusCode: 200, Body: []byte("a")}, time.Hour))
+
+	sealed, err := inner.Get("key-a")
+	require.NoError(t, err)
+	require.NoError(t, inner.Set("key-b", sealed, time.Hour))
+
+	_, err = store.Get("key-b")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestEncryptedStore_KeyRotation(t *testing.T) {
+	inner := NewMemoryStore()
+	old, err := NewEncryptedStore(inner, "k1", map[string][]byte{"k1": testKey1})
+	require.NoError(t, err)
+	require.NoError(t, old.Set("old-key", &idempotency.CachedResponse{StatusCode: 200, Body: []byte("old")}, time.Hour))
+
+	rotated, err := NewEncryptedStore(inner, "k2", map[string][]byte{"k1": testKey1, "k2": testKey2})
+	require.NoError(t, err)
+	require.NoError(t, rotated.Set("new-key", &idempotency.CachedResponse{StatusCode: 200, Body: []byte("new")}, time.Hour))
+
+	cached, err := rotated.Get("old-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), cached.Body)
+
+	// Once k1 is dropped its records can't be read anymore
+	retired, err := NewEncryptedStore(inner, "k2", map[string][]byte{"k2": testKey2})
+	require.NoError(t, err)
+	_, err = retired.Get("old-key")
+	assert.ErrorIs(t, err, ErrDecrypt)
+	cached, err = retired.Get("new-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), cached.Body)
+}
+
+func TestEncryptedStore_Records(t *testing.T) {
+	redisStore, _ := setupTestRedis(t)
+	store, err := NewEncryptedStore(redisStore, "k1", map[string][]byte{"k1": testKey1})
+	require.NoError(t, err)
+	owner := idempotency.DefaultOwner()
+
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte(`{"card":"4242"}`)}
+	require.NoError(t, store.Complete("test-key", rec, response, time.Hour))
+
+	rec, started, err = store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, 201, rec.Response.StatusCode)
+	assert.Equal(t, response.Body, rec.Response.Body)
+}
+
+func TestEncryptedStore_PlaintextUntil(t *testing.T) {
+	inner := NewMemoryStore()
+	owner := idempotency.DefaultOwner()
+
+	// Stored before encryption was enabled
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte("ok")}
+	require.NoError(t, inner.Set("test-key", response, time.Hour))
+
+	strict, err := NewEncryptedStore(inner, "k1", map[string][]byte{"k1": testKey1})
+	require.NoError(t, err)
+	_, _, err = strict.Begin("test-key", owner, time.Hour)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	store, err := NewEncryptedStore(inner, "k1", map[string][]byte{"k1": testKey1},
+		WithPlaintextUntil(time.Now().Add(time.Hour)))
+	require.NoError(t, err)
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, 201, rec.Response.StatusCode)
+	assert.Equal(t, []byte("ok"), rec.Response.Body)
+
+	// Encrypted responses are still decrypted
+	require.NoError(t, store.Set("sealed-key", response, time.Hour))
+	cached, err := store.Get("sealed-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ok"), cached.Body)
+
+	// Once the grace period ended plaintext is refused again
+	ended, err := NewEncryptedStore(inner, "k1", map[string][]byte{"k1": testKey1},
+		WithPlaintextUntil(time.Now().Add(-time.Second)))
+	require.NoError(t, err)
+	_, err = ended.Get("test-key")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestNewEncryptedStore_InvalidKeys(t *testing.T) {
+	_, err := NewEncryptedStore(NewMemoryStore(), "missing", map[string][]byte{"k1": testKey1})
+	assert.Error(t, err)
+
+	_, err = NewEncryptedStore(NewMemoryStore(), "k1", map[string][]byte{"k1": []byte("short")})
+	assert.Error(t, err)
+}
+
+func TestEncryptedStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		store, err := NewEncryptedStore(NewMemoryStore(), "k1", map[string][]byte{"k1": testKey1})
+		require.NoError(t, err)
+		return store
+	})
+}
@@ -0,0 +1,86 @@
+package store
+
+import "container/heap"
+
+// EvictionPolicy selects which records a bounded MemoryStore evicts first
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used record
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least frequently used record, the least recently
+	// used one among equally used records
+	EvictLFU
+)
+
+// OverflowPolicy selects what a bounded MemoryStore does with a new record
+// once it is full
+type OverflowPolicy int
+
+const (
+	// OverflowEvict evicts records to make room
+	OverflowEvict OverflowPolicy = iota
+	// OverflowReject fails the write with ErrStoreFull
+	OverflowReject
+)
+
+// evictionQueue orders evictable entries, the next victim first
+type evictionQueue struct {
+	entries []*entry
+	policy  EvictionPolicy
+}
+
+func (q *evictionQueue) Len() int { return len(q.entries) }
+
+func (q *evictionQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if q.policy == EvictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastUsed < b.lastUsed
+}
+
+func (q *evictionQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].index = i
+	q.entries[j].index = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	n := len(q.entries) - 1
+	e := q.entries[n]
+	q.entries[n] = nil
+	q.entries = q.entries[:n]
+	e.index = -1
+	return e
+}
+
+// push adds e to the queue
+func (q *evictionQueue) push(e *entry) {
+	heap.Push(q, e)
+}
+
+// remove drops e from the queue if it is queued
+func (q *evictionQueue) remove(e *entry) {
+	if e.index >= 0 {
+		heap.Remove(q, e.index)
+	}
+}
+
+// fix restores the order after e was used
+func (q *evictionQueue) fix(e *entry) {
+	if e.index >= 0 {
+		heap.Fix(q, e.index)
+	}
+}
+
+// pop removes and returns the next victim
+func (q *evictionQueue) pop() *entry {
+	return heap.Pop(q).(*entry)
+}
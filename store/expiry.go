@@ -0,0 +1,70 @@
+package store
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiry is the expiration of the item stored under key
+type expiry struct {
+	key         string
+	expiresAt   time.Time
+	expiryIndex int
+}
+
+// expiryQueue orders items by expiration, the first to expire first
+type expiryQueue []*expiry
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiresAt.Before(q[j].expiresAt) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].expiryIndex = i
+	q[j].expiryIndex = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*expiry)
+	item.expiryIndex = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old) - 1
+	item := old[n]
+	old[n] = nil
+	*q = old[:n]
+	item.expiryIndex = -1
+	return item
+}
+
+// push adds item to the queue
+func (q *expiryQueue) push(item *expiry) {
+	heap.Push(q, item)
+}
+
+// remove drops item from the queue if it is queued
+func (q *expiryQueue) remove(item *expiry) {
+	if item.expiryIndex >= 0 {
+		heap.Remove(q, item.expiryIndex)
+	}
+}
+
+// fix restores the order after the expiration of item changed
+func (q *expiryQueue) fix(item *expiry) {
+	if item.expiryIndex >= 0 {
+		heap.Fix(q, item.expiryIndex)
+	}
+}
+
+// expired pops and returns the keys of the items expired at now
+func (q *expiryQueue) expired(now time.Time) []string {
+	var keys []string
+	for len(*q) > 0 && now.After((*q)[0].expiresAt) {
+		keys = append(keys, heap.Pop(q).(*expiry).key)
+	}
+	return keys
+}
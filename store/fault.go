@@ -0,0 +1,213 @@
+package store
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// ErrInjected is the error of faults injected by a FaultStore
+var ErrInjected = errors.New("injected store fault")
+
+// Op names a store operation faults are injected into
+type Op string
+
+const (
+	// OpGet is Store.Get
+	OpGet Op = "get"
+	// OpSet is Store.Set
+	OpSet Op = "set"
+	// OpLock is Store.Lock
+	OpLock Op = "lock"
+	// OpBegin is RecordStore.Begin
+	OpBegin Op = "begin"
+	// OpHeartbeat is RecordStore.Heartbeat
+	OpHeartbeat Op = "heartbeat"
+	// OpTakeover is RecordStore.Takeover
+	OpTakeover Op = "takeover"
+	// OpComplete is RecordStore.Complete
+	OpComplete Op = "complete"
+	// OpFail is RecordStore.Fail
+	OpFail Op = "fail"
+)
+
+// Fault describes what goes wrong in one store call. The zero Fault
+// passes the call through unchanged.
+type Fault struct {
+	// Latency delays the call
+	Latency time.Duration
+
+	// Err is returned instead of calling the wrapped store
+	Err error
+
+	// Drop reports success for a write without performing it.
+	// A dropped Begin or Takeover starts a record that is never stored.
+	Drop bool
+}
+
+// LockTimeout returns a fault making a lock attempt wait, then fail as if
+// the lock were held by another request. Injected into Begin or Takeover,
+// the call finds the record in progress instead.
+func LockTimeout(wait time.Duration) Fault {
+	return Fault{Latency: wait, Err: idempotency.ErrRequestInProgress}
+}
+
+// FaultStore wraps a store and injects latency, errors and dropped writes
+// into its calls, for testing how a service copes with a slow or flaky store.
+//
+// Faults are either scripted, where the n-th call of an operation gets the
+// n-th fault of its script, or random, where each call fails with a given
+// probability. A scripted fault takes precedence over random ones.
+type FaultStore struct {
+	inner   idempotency.Store
+	records idempotency.RecordStore
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	scripts map[Op][]Fault
+	rates   map[Op][]faultRate
+	calls   map[Op]int
+}
+
+type faultRate struct {
+	probability float64
+	fault       Fault
+}
+
+// NewFaultStore wraps inner, injecting the faults configured by opts
+func NewFaultStore(inner idempotency.Store, opts ...FaultOption) *FaultStore {
+	s := &FaultStore{
+		inner:   inner,
+		records: idempotency.AsRecordStore(inner),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		scripts: make(map[Op][]Fault),
+		rates:   make(map[Op][]faultRate),
+		calls:   make(map[Op]int),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Calls returns how many times op was called
+func (s *FaultStore) Calls(op Op) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op]
+}
+
+// Get retrieves a cached response from the wrapped store
+func (s *FaultStore) Get(key string) (*idempotency.CachedResponse, error) {
+	if f := s.inject(OpGet); f.Err != nil {
+		return nil, f.Err
+	}
+	return s.inner.Get(key)
+}
+
+// Set stores a response in the wrapped store
+func (s *FaultStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
+	if f := s.inject(OpSet); f.Err != nil || f.Drop {
+		return f.Err
+	}
+	return s.inner.Set(key, response, ttl)
+}
+
+// Lock acquires a lock from the wrapped store
+func (s *FaultStore) Lock(key string) (func(), error) {
+	if f := s.inject(OpLock); f.Err != nil {
+		return nil, f.Err
+	}
+	return s.inner.Lock(key)
+}
+
+// Begin starts a record in the wrapped store
+func (s *FaultStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	f := s.inject(OpBegin)
+	if errors.Is(f.Err, idempotency.ErrRequestInProgress) {
+		return inProgressRecord(key), false, nil
+	}
+	if f.Err != nil {
+		return nil, false, f.Err
+	}
+	if f.Drop {
+		return newStartedRecord(key, owner, nil), true, nil
+	}
+	return s.records.Begin(key, owner, ttl)
+}
+
+// Heartbeat refreshes a record in the wrapped store
+func (s *FaultStore) Heartbeat(key string, owner idempotency.Owner) error {
+	if f := s.inject(OpHeartbeat); f.Err != nil || f.Drop {
+		return f.Err
+	}
+	return s.records.Heartbeat(key, owner)
+}
+
+// Takeover takes over a record in the wrapped store
+func (s *FaultStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	f := s.inject(OpTakeover)
+	if errors.Is(f.Err, idempotency.ErrRequestInProgress) {
+		return inProgressRecord(key), false, nil
+	}
+	if f.Err != nil {
+		return nil, false, f.Err
+	}
+	if f.Drop {
+		return newStartedRecord(key, owner, stale), true, nil
+	}
+	return s.records.Takeover(key, stale, owner)
+}
+
+// Complete completes a record in the wrapped store
+func (s *FaultStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	if f := s.inject(OpComplete); f.Err != nil || f.Drop {
+		return f.Err
+	}
+	return s.records.Complete(key, rec, response, ttl)
+}
+
+// Fail fails a record in the wrapped store
+func (s *FaultStore) Fail(key string, rec *idempotency.Record) error {
+	if f := s.inject(OpFail); f.Err != nil || f.Drop {
+		return f.Err
+	}
+	return s.records.Fail(key, rec)
+}
+
+// inProgressRecord returns the record of key as found while another
+// request holds it
+func inProgressRecord(key string) *idempotency.Record {
+	return &idempotency.Record{Key: key, State: idempotency.StateStarted}
+}
+
+// inject picks the fault of the next call of op and applies its latency
+func (s *FaultStore) inject(op Op) Fault {
+	s.mu.Lock()
+	n := s.calls[op]
+	s.calls[op]++
+
+	var f Fault
+	if script := s.scripts[op]; n < len(script) {
+		f = script[n]
+	} else {
+		for _, rate := range s.rates[op] {
+			if s.rng.Float64() < rate.probability {
+				f = rate.fault
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	return f
+}
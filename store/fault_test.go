@@ -0,0 +1,106 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultStore_Script(t *testing.T) {
+	store := NewFaultStore(NewMemoryStore(),
+		WithFaultScript(OpGet, Fault{}, Fault{Err: ErrInjected}),
+	)
+	require.NoError(t, store.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+
+	_, err := store.Get("test-key")
+	assert.NoError(t, err)
+	_, err = store.Get("test-key")
+	assert.ErrorIs(t, err, ErrInjected)
+
+	// The script is over, calls pass through again
+	_, err = store.Get("test-key")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, store.Calls(OpGet))
+}
+
+func TestFaultStore_DroppedWrites(t *testing.T) {
+	inner := NewMemoryStore()
+	store := NewFaultStore(inner,
+		WithFaultScript(OpBegin, Fault{Drop: true}),
+		WithFaultScript(OpComplete, Fault{Drop: true}),
+	)
+	owner := idempotency.DefaultOwner()
+
+	// The dropped Begin looks successful but stores nothing
+	_, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, started)
+	started2, started, err := inner.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	require.NoError(t, store.Complete("test-key", started2, &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+	rec, _, err := inner.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, idempotency.StateStarted, rec.State)
+}
+
+func TestFaultStore_Rate(t *testing.T) {
+	failures := func(seed int64) []int {
+		store := NewFaultStore(NewMemoryStore(),
+			WithFaultSeed(seed),
+			WithFaultRate(OpGet, 0.5, Fault{Err: ErrInjected}),
+		)
+
+		var failed []int
+		for i := 0; i < 100; i++ {
+			if _, err := store.Get("test-key"); err == ErrInjected {
+				failed = append(failed, i)
+			}
+		}
+		return failed
+	}
+
+	// The same seed injects the same faults
+	failed := failures(42)
+	assert.Equal(t, failed, failures(42))
+	assert.Greater(t, len(failed), 20)
+	assert.Less(t, len(failed), 80)
+}
+
+func TestFaultStore_LockTimeout(t *testing.T) {
+	store := NewFaultStore(NewMemoryStore(), WithFaultRate(OpLock, 1, LockTimeout(50*time.Millisecond)))
+
+	start := time.Now()
+	_, err := store.Lock("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrRequestInProgress)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestFaultStore_LockTimeoutOnBegin(t *testing.T) {
+	store := NewFaultStore(NewMemoryStore(),
+		WithFaultScript(OpBegin, LockTimeout(0)),
+		WithFaultScript(OpTakeover, LockTimeout(0)),
+	)
+	owner := idempotency.DefaultOwner()
+
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateStarted, rec.State)
+
+	rec, started, err = store.Takeover("test-key", rec, owner)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateStarted, rec.State)
+}
+
+func TestFaultStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		return NewFaultStore(NewMemoryStore())
+	})
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+const (
+	// fileRecordVersion is the current format version of record files
+	fileRecordVersion byte = 1
+
+	// recordLockWait bounds how long a record update waits for another one
+	recordLockWait = 5 * time.Second
+	// lockPollInterval is the interval between attempts to take a busy file lock
+	lockPollInterval = 5 * time.Millisecond
+	// tempFileMaxAge is the age after which the sweeper removes temporary
+	// files left behind by a crashed writer
+	tempFileMaxAge = time.Hour
+)
+
+// errLockBusy is returned when a file lock is held by someone else
+var errLockBusy = errors.New("file lock is busy")
+
+// FileStore is a filesystem-backed implementation of Store.
+// Each record is kept in its own file, replaced atomically on every update.
+// Updates are serialized with OS file locks, so several processes sharing
+// the directory on one host coordinate. Expired files are swept in the
+// background, which Close stops.
+//
+// Files are named after the SHA-256 of the store key:
+// <hash>.rec holds the record, <hash>.mu serializes its updates and
+// <hash>.lock backs Lock.
+type FileStore struct {
+	dir string
+
+	sweepInterval time.Duration
+	closeOnce     sync.Once
+	done          chan struct{}
+	background    sync.WaitGroup
+}
+
+// NewFileStore creates a store keeping records in dir, creating it if needed
+func NewFileStore(dir string, opts ...FileOption) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		dir:           dir,
+		sweepInterval: DefaultCleanupInterval,
+		done:          make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.sweepInterval > 0 {
+		s.background.Add(1)
+		go s.sweepLoop()
+	}
+
+	return s, nil
+}
+
+// Close stops the background sweep of expired files
+func (s *FileStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.background.Wait()
+	})
+	return nil
+}
+
+// Get retrieves a cached response
+func (s *FileStore) Get(key string) (*idempotency.CachedResponse, error) {
+	rec, _, err := s.read(keyHash(key))
+	if err != nil {
+		return nil, err
+	}
+	if rec.State != idempotency.StateCompleted {
+		return nil, idempotency.ErrNotFound
+	}
+
+	return rec.Response, nil
+}
+
+// Set stores a response with TTL
+func (s *FileStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
+	id := keyHash(key)
+	return s.update(id, func() error {
+		now := time.Now()
+		return s.write(id, &idempotency.Record{
+			Key:       key,
+			State:     idempotency.StateCompleted,
+			Response:  response,
+			StartedAt: now,
+			UpdatedAt: now,
+		}, now.Add(ttl))
+	})
+}
+
+// Begin creates a started record for key, or returns the current one
+func (s *FileStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	id := keyHash(key)
+
+	var rec *idempotency.Record
+	var started bool
+	err := s.update(id, func() error {
+		current, _, err := s.read(id)
+		var prev *idempotency.Record
+		switch {
+		case err == nil && current.State != idempotency.StateFailed:
+			rec = current
+			return nil
+		case err == nil:
+			prev = current
+		case !errors.Is(err, idempotency.ErrNotFound):
+			return err
+		}
+
+		rec, started = newStartedRecord(key, owner, prev), true
+		return s.write(id, rec, time.Now().Add(ttl))
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return rec, started, nil
+}
+
+// Heartbeat refreshes the heartbeat of a started record owned by owner
+func (s *FileStore) Heartbeat(key string, owner idempotency.Owner) error {
+	id := keyHash(key)
+	return s.update(id, func() error {
+		rec, expiresAt, err := s.read(id)
+		if err != nil {
+			return err
+		}
+		if rec.State != idempotency.StateStarted || !rec.Owner.Equal(owner) {
+			return idempotency.ErrNotOwner
+		}
+
+		rec.HeartbeatAt = time.Now()
+		return s.write(id, rec, expiresAt)
+	})
+}
+
+// Takeover replaces a stale started record with a new attempt owned by owner
+func (s *FileStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	id := keyHash(key)
+
+	var rec *idempotency.Record
+	var started bool
+	err := s.update(id, func() error {
+		current, expiresAt, err := s.read(id)
+		if err != nil {
+			return err
+		}
+		if !sameAttempt(current, stale) {
+			rec = current
+			return nil
+		}
+
+		rec, started = newStartedRecord(key, owner, current), true
+		return s.write(id, rec, expiresAt)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return rec, started, nil
+}
+
+// Complete stores the response and marks the started record rec completed
+func (s *FileStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	id := keyHash(key)
+	return s.update(id, func() error {
+		current, _, err := s.read(id)
+		if err != nil {
+			return err
+		}
+		if !completableBy(current, rec) {
+			return idempotency.ErrNotOwner
+		}
+
+		now := time.Now()
+		current.State = idempotency.StateCompleted
+		current.Response = response
+		current.UpdatedAt = now
+		return s.write(id, current, now.Add(ttl))
+	})
+}
+
+// Fail marks the started record rec failed so the next Begin re-runs the request
+func (s *FileStore) Fail(key string, rec *idempotency.Record) error {
+	id := keyHash(key)
+	return s.update(id, func() error {
+		current, expiresAt, err := s.read(id)
+		if err != nil {
+			return err
+		}
+		if !sameAttempt(current, rec) {
+			return idempotency.ErrNotOwner
+		}
+
+		current.State = idempotency.StateFailed
+		current.UpdatedAt = time.Now()
+		return s.write(id, current, expiresAt)
+	})
+}
+
+// Lock acquires a lock for the given key, shared with other processes
+func (s *FileStore) Lock(key string) (func(), error) {
+	unlock, err := lockFile(s.path(keyHash(key), ".lock"), 100*time.Millisecond)
+	if errors.Is(err, errLockBusy) {
+		return nil, idempotency.ErrRequestInProgress
+	}
+	return unlock, err
+}
+
+// update runs fn holding the update lock of the record id
+func (s *FileStore) update(id string, fn func() error) error {
+	unlock, err := lockFile(s.path(id, ".mu"), recordLockWait)
+	if errors.Is(err, errLockBusy) {
+		return idempotency.ErrLockFailed
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fn()
+}
+
+// read returns the unexpired record id and its expiration.
+// Record file layout: version | expiration | record encoded by DefaultCodec.
+func (s *FileStore) read(id string) (*idempotency.Record, time.Time, error) {
+	data, err := os.ReadFile(s.path(id, ".rec"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, idempotency.ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	expiresAt, encoded, err := parseRecordFile(data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !time.Now().Before(expiresAt) {
+		return nil, time.Time{}, idempotency.ErrNotFound
+	}
+
+	rec, err := DefaultCodec.Unmarshal(encoded)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return rec, expiresAt, nil
+}
+
+// write atomically replaces the file of record id
+func (s *FileStore) write(id string, rec *idempotency.Record, expiresAt time.Time) error {
+	encoded, err := DefaultCodec.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	data := appendTime([]byte{fileRecordVersion}, expiresAt)
+	return writeFileAtomic(s.path(id, ".rec"), append(data, encoded...))
+}
+
+// path returns the path of the file of record id with the given extension
+func (s *FileStore) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// sweepLoop periodically sweeps expired files until the store is closed
+func (s *FileStore) sweepLoop() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sweep(time.Now())
+		}
+	}
+}
+
+// sweep removes expired record files, lock files no longer backing a record
+// and temporary files abandoned by crashed writers
+func (s *FileStore) sweep(now time.Time) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.Contains(name, ".tmp-"):
+			if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > tempFileMaxAge {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+		case strings.HasSuffix(name, ".rec"):
+			id := strings.TrimSuffix(name, ".rec")
+			s.update(id, func() error {
+				data, err := os.ReadFile(s.path(id, ".rec"))
+				if err != nil {
+					return err
+				}
+				expiresAt, _, err := parseRecordFile(data)
+				if err != nil || now.Before(expiresAt) {
+					return err
+				}
+				return os.Remove(s.path(id, ".rec"))
+			})
+		}
+	}
+
+	// Lock files are removed while locked, so nobody is holding them
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if ext != ".mu" && ext != ".lock" {
+			continue
+		}
+		if _, err := os.Stat(s.path(strings.TrimSuffix(name, ext), ".rec")); err == nil {
+			continue
+		}
+		if unlock, err := tryLockFile(filepath.Join(s.dir, name)); err == nil {
+			os.Remove(filepath.Join(s.dir, name))
+			unlock()
+		}
+	}
+}
+
+// parseRecordFile splits a record file into its expiration and encoded record
+func parseRecordFile(data []byte) (time.Time, []byte, error) {
+	if len(data) == 0 || data[0] != fileRecordVersion {
+		return time.Time{}, nil, fmt.Errorf("%w: record file", ErrUnknownFormat)
+	}
+
+	r := &binaryReader{data: data[1:]}
+	expiresAt := r.time()
+	if r.err != nil {
+		return time.Time{}, nil, r.err
+	}
+
+	return expiresAt, r.data, nil
+}
+
+// lockFile takes the file lock at path, waiting up to wait for it
+func lockFile(path string, wait time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+	for {
+		unlock, err := tryLockFile(path)
+		if !errors.Is(err, errLockBusy) || time.Now().After(deadline) {
+			return unlock, err
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockedFileCurrent reports whether path still names the open file f
+func lockedFileCurrent(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	return err == nil && os.SameFile(fi, pi)
+}
+
+// keyHash returns the SHA-256 of key in hex, naming its files and rows
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestFileStore(t *testing.T, dir string) *FileStore {
+	store, err := NewFileStore(dir, WithSweepInterval(0))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestFileStore_SetAndGet(t *testing.T) {
+	dir := t.TempDir()
+	store := setupTestFileStore(t, dir)
+
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte(`{"id":1}`)}
+	require.NoError(t, store.Set("test-key", response, time.Hour))
+
+	cached, err := store.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, 201, cached.StatusCode)
+	assert.Equal(t, response.Body, cached.Body)
+
+	// Records survive a restart
+	reopened := setupTestFileStore(t, dir)
+	cached, err = reopened.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, response.Body, cached.Body)
+
+	_, err = store.Get("nonexistent")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func TestFileStore_Expiration(t *testing.T) {
+	store := setupTestFileStore(t, t.TempDir())
+
+	require.NoError(t, store.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, 50*time.Millisecond))
+	time.Sleep(60 * time.Millisecond)
+
+	_, err := store.Get("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func TestFileStore_ConcurrentBegin(t *testing.T) {
+	dir := t.TempDir()
+	// Separate stores stand in for separate processes
+	stores := []*FileStore{setupTestFileStore(t, dir), setupTestFileStore(t, dir)}
+
+	var wg sync.WaitGroup
+	var startedCount atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(store *FileStore) {
+			defer wg.Done()
+			_, started, err := store.Begin("test-key", idempotency.DefaultOwner(), time.Hour)
+			assert.NoError(t, err)
+			if started {
+				startedCount.Add(1)
+			}
+		}(stores[i%2])
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), startedCount.Load())
+}
+
+func TestFileStore_Lock(t *testing.T) {
+	dir := t.TempDir()
+	store := setupTestFileStore(t, dir)
+	other := setupTestFileStore(t, dir)
+
+	unlock, err := store.Lock("test-key")
+	require.NoError(t, err)
+
+	_, err = other.Lock("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrRequestInProgress)
+
+	unlock()
+	unlock, err = other.Lock("test-key")
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestFileStore_Sweep(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, WithSweepInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	require.NoError(t, store.Set("short", &idempotency.CachedResponse{StatusCode: 200}, 20*time.Millisecond))
+	require.NoError(t, store.Set("long", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+	unlock, err := store.Lock("short")
+	require.NoError(t, err)
+	unlock()
+
+	// Only the long-lived record and its update lock remain
+	assert.Eventually(t, func() bool {
+		files, err := os.ReadDir(dir)
+		return err == nil && len(files) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = store.Get("long")
+	assert.NoError(t, err)
+}
+
+func TestTryLockMarker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.mu")
+
+	unlock, err := tryLockMarker(path, 100*time.Millisecond)
+	require.NoError(t, err)
+	_, err = tryLockMarker(path, 100*time.Millisecond)
+	assert.ErrorIs(t, err, errLockBusy)
+
+	// The holder keeps its marker fresh past the lease
+	time.Sleep(250 * time.Millisecond)
+	_, err = tryLockMarker(path, 100*time.Millisecond)
+	assert.ErrorIs(t, err, errLockBusy)
+
+	unlock()
+	assert.NoFileExists(t, path)
+}
+
+func TestTryLockMarker_BreaksStaleMarker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.mu")
+
+	// Left behind by a crashed process
+	require.NoError(t, os.WriteFile(path, []byte("host/42/dead"), 0o600))
+	_, err := tryLockMarker(path, time.Minute)
+	assert.ErrorIs(t, err, errLockBusy)
+
+	old := time.Now().Add(-2 * time.Minute)
+	require.NoError(t, os.Chtimes(path, old, old))
+	unlock, err := tryLockMarker(path, time.Minute)
+	require.NoError(t, err)
+
+	// A holder whose marker was broken and taken leaves the new one alone
+	require.NoError(t, os.WriteFile(path, []byte("host/43/next"), 0o600))
+	unlock()
+	assert.FileExists(t, path)
+}
+
+func TestFileStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		return setupTestFileStore(t, t.TempDir())
+	})
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// markerLease is how long a lock marker is honored without being refreshed
+const markerLease = 10 * time.Second
+
+// tryLockMarker takes a lock by exclusively creating a marker file at path,
+// without waiting, on platforms without OS file locks. The holder refreshes
+// the marker's modification time while it holds the lock, so the marker of a
+// crashed process is broken once it is older than lease. The marker names its
+// holder, which only removes it while it still holds it.
+func tryLockMarker(path string, lease time.Duration) (unlock func(), err error) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), hex.EncodeToString(nonce[:]))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if errors.Is(err, fs.ErrExist) && breakStaleMarker(path, lease) {
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return nil, errLockBusy
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(owner)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(lease / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if !holdsMarker(path, owner) {
+					return
+				}
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			if holdsMarker(path, owner) {
+				os.Remove(path)
+			}
+		})
+	}, nil
+}
+
+// breakStaleMarker removes the marker at path if it wasn't refreshed within
+// lease and reports whether the lock may be taken again
+func breakStaleMarker(path string, lease time.Duration) bool {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	if err != nil || time.Since(fi.ModTime()) < lease {
+		return false
+	}
+
+	err = os.Remove(path)
+	return err == nil || errors.Is(err, fs.ErrNotExist)
+}
+
+// holdsMarker reports whether the marker at path names owner
+func holdsMarker(path, owner string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && string(data) == owner
+}
@@ -0,0 +1,8 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package store
+
+// tryLockFile takes a lock marker at path without waiting, see tryLockMarker
+func tryLockFile(path string) (unlock func(), err error) {
+	return tryLockMarker(path, markerLease)
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+package store
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// tryLockFile takes an exclusive LockFileEx lock on the file at path without
+// waiting. The lock is tied to the open handle, so it is released when its
+// process dies.
+func tryLockFile(path string) (unlock func(), err error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	// Shared for deletion, so the sweeper can remove the file while locked
+	h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_ALWAYS, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(h), path)
+
+	overlapped := new(windows.Overlapped)
+	if err := windows.LockFileEx(h, windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0, overlapped); err != nil {
+		f.Close()
+		if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+			return nil, errLockBusy
+		}
+		return nil, err
+	}
+
+	// The file may have been removed by the sweeper after we opened it,
+	// in which case another process can lock a new file at path
+	if !lockedFileCurrent(f, path) {
+		f.Close()
+		return nil, errLockBusy
+	}
+
+	return func() {
+		windows.UnlockFileEx(h, 0, 1, 0, overlapped)
+		f.Close()
+	}, nil
+}
@@ -1,106 +1,235 @@
 package store
 
 import (
+	"errors"
+	"hash/maphash"
 	"sync"
 	"time"
 
 	"github.com/AnandSundar/go-idempotency"
 )
 
-// MemoryStore is an in-memory implementation of Store
+// DefaultCleanupInterval is the default interval between sweeps of expired records
+const DefaultCleanupInterval = time.Minute
+
+// ErrStoreFull is returned when a bounded MemoryStore has no room for a new record
+var ErrStoreFull = errors.New("memory store is full")
+
+// MemoryStore is an in-memory implementation of Store.
+//
+// It can be bounded by entry count and total body bytes. Only completed and
+// failed records are evicted; a started record is kept until it completes,
+// so evictions never let a request run twice. Completing a record is always
+// accepted, even when its response takes the store over its byte budget.
+//
+// With WithShards, keys are spread over independently locked shards that
+// each get an equal share of the bounds, so eviction order only holds
+// within a shard.
+//
+// Expired records are swept in the background, which Close stops. With
+// WithSnapshot, records are also saved to a file periodically and on Close,
+// to be restored with LoadSnapshot after a restart.
 type MemoryStore struct {
-	mu      sync.RWMutex
-	data    map[string]*entry
-	locks   map[string]*sync.Mutex
-	locksMu sync.Mutex
+	shards []*memoryShard
+	seed   maphash.Seed
+
+	shardCount int
+	maxEntries int
+	maxBytes   int64
+	overflow   OverflowPolicy
+	eviction   EvictionPolicy
+
+	cleanupInterval time.Duration
+	closeOnce       sync.Once
+	done            chan struct{}
+	background      sync.WaitGroup
+
+	snapshotPath     string
+	snapshotInterval time.Duration
 }
 
-type entry struct {
-	response  *idempotency.CachedResponse
-	expiresAt time.Time
+// MemoryStats reports the usage of a MemoryStore
+type MemoryStats struct {
+	Entries    int
+	Bytes      int64
+	Evictions  uint64
+	Rejections uint64
 }
 
-// NewMemoryStore creates a new in-memory store
-func NewMemoryStore() *MemoryStore {
+// NewMemoryStore creates a new in-memory store, unbounded by default
+func NewMemoryStore(opts ...MemoryOption) *MemoryStore {
 	s := &MemoryStore{
-		data:  make(map[string]*entry),
-		locks: make(map[string]*sync.Mutex),
+		seed:       maphash.MakeSeed(),
+		shardCount: 1,
+
+		cleanupInterval: DefaultCleanupInterval,
+		done:            make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.shardCount < 1 {
+		s.shardCount = 1
+	}
+	// Every shard needs a share of at least one of each bound
+	for _, bound := range []int64{int64(s.maxEntries), s.maxBytes} {
+		if bound > 0 && bound < int64(s.shardCount) {
+			s.shardCount = int(bound)
+		}
+	}
+
+	s.shards = make([]*memoryShard, s.shardCount)
+	for i := range s.shards {
+		maxEntries := int(shareOf(int64(s.maxEntries), s.shardCount, i))
+		s.shards[i] = newMemoryShard(maxEntries, shareOf(s.maxBytes, s.shardCount, i), s.overflow, s.eviction)
 	}
 
 	// Start cleanup goroutine
-	go s.cleanup()
+	if s.cleanupInterval > 0 {
+		s.background.Add(1)
+		go s.cleanup()
+	}
+	if s.snapshotPath != "" && s.snapshotInterval > 0 {
+		s.background.Add(1)
+		go s.saveSnapshots()
+	}
 
 	return s
 }
 
-// Get retrieves a cached response
-func (s *MemoryStore) Get(key string) (*idempotency.CachedResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	entry, exists := s.data[key]
-	if !exists {
-		return nil, idempotency.ErrNotFound
-	}
+// Close stops the background work of the store and saves a final snapshot
+// if configured. The store remains usable; expired records are then only
+// hidden, not freed.
+func (s *MemoryStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.background.Wait()
+
+		if s.snapshotPath != "" {
+			err = s.SaveSnapshot(s.snapshotPath)
+		}
+	})
+	return err
+}
 
-	if time.Now().After(entry.expiresAt) {
-		return nil, idempotency.ErrNotFound
+// Stats returns the current usage of the store, summed over its shards
+func (s *MemoryStore) Stats() MemoryStats {
+	var stats MemoryStats
+	for _, sh := range s.shards {
+		shardStats := sh.stats()
+		stats.Entries += shardStats.Entries
+		stats.Bytes += shardStats.Bytes
+		stats.Evictions += shardStats.Evictions
+		stats.Rejections += shardStats.Rejections
 	}
+	return stats
+}
 
-	return entry.response, nil
+// Get retrieves a cached response
+func (s *MemoryStore) Get(key string) (*idempotency.CachedResponse, error) {
+	return s.shard(key).Get(key)
 }
 
 // Set stores a response with TTL
 func (s *MemoryStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.shard(key).Set(key, response, ttl)
+}
 
-	s.data[key] = &entry{
-		response:  response,
-		expiresAt: time.Now().Add(ttl),
-	}
+// Begin creates a started record for key, or returns the current one
+func (s *MemoryStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	return s.shard(key).Begin(key, owner, ttl)
+}
+
+// Heartbeat refreshes the heartbeat of a started record owned by owner
+func (s *MemoryStore) Heartbeat(key string, owner idempotency.Owner) error {
+	return s.shard(key).Heartbeat(key, owner)
+}
+
+// Takeover replaces a stale started record with a new attempt owned by owner
+func (s *MemoryStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	return s.shard(key).Takeover(key, stale, owner)
+}
+
+// Complete stores the response and marks the started record rec completed
+func (s *MemoryStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	return s.shard(key).Complete(key, rec, response, ttl)
+}
+
+// Fail marks the started record rec failed so the next Begin re-runs the request
+func (s *MemoryStore) Fail(key string, rec *idempotency.Record) error {
+	return s.shard(key).Fail(key, rec)
+}
 
-	return nil
+// IncrAttempt increments and returns the attempt count for key
+func (s *MemoryStore) IncrAttempt(key string, ttl time.Duration) (int, error) {
+	return s.shard(key).IncrAttempt(key, ttl)
 }
 
 // Lock acquires a lock for the given key
 func (s *MemoryStore) Lock(key string) (func(), error) {
-	s.locksMu.Lock()
-	mu, exists := s.locks[key]
-	if !exists {
-		mu = &sync.Mutex{}
-		s.locks[key] = mu
-	}
-	s.locksMu.Unlock()
-
-	// Try to acquire lock with timeout
-	locked := make(chan struct{})
-	go func() {
-		mu.Lock()
-		close(locked)
-	}()
-
-	select {
-	case <-locked:
-		return func() { mu.Unlock() }, nil
-	case <-time.After(100 * time.Millisecond):
-		return nil, idempotency.ErrRequestInProgress
+	unlock, _, err := s.LockFenced(key)
+	return unlock, err
+}
+
+// LockFenced acquires a lock for the given key and returns its fencing token
+func (s *MemoryStore) LockFenced(key string) (func(), uint64, error) {
+	return s.shard(key).LockFenced(key)
+}
+
+// shard returns the shard holding key
+func (s *MemoryStore) shard(key string) *memoryShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
 	}
+	return s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
 }
 
-// cleanup periodically removes expired entries
+// cleanup periodically removes expired entries until the store is closed
 func (s *MemoryStore) cleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
+	defer s.background.Done()
+
+	ticker := time.NewTicker(s.cleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		s.mu.Lock()
-		now := time.Now()
-		for key, entry := range s.data {
-			if now.After(entry.expiresAt) {
-				delete(s.data, key)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			for _, sh := range s.shards {
+				sh.sweep(now)
 			}
 		}
-		s.mu.Unlock()
 	}
 }
+
+// saveSnapshots periodically saves a snapshot until the store is closed
+func (s *MemoryStore) saveSnapshots() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(s.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			// A failed snapshot is retried at the next tick
+			s.SaveSnapshot(s.snapshotPath)
+		}
+	}
+}
+
+// shareOf returns the share of shard i when splitting a bound over n shards.
+// The shares sum up to the bound. Zero stays unbounded.
+func shareOf(bound int64, n, i int) int64 {
+	share := bound / int64(n)
+	if int64(i) < bound%int64(n) {
+		share++
+	}
+	return share
+}
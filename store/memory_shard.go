@@ -0,0 +1,402 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// memoryShard is an independently locked segment of a MemoryStore
+type memoryShard struct {
+	mu       sync.RWMutex
+	data     map[string]*entry
+	attempts map[string]*attempt
+	locks    map[string]*keyLock
+	fence    uint64
+	locksMu  sync.Mutex
+
+	maxEntries int
+	maxBytes   int64
+	overflow   OverflowPolicy
+
+	bytes      int64
+	clock      uint64
+	evictable  evictionQueue
+	evictions  uint64
+	rejections uint64
+
+	expiries        expiryQueue
+	attemptExpiries expiryQueue
+}
+
+type entry struct {
+	expiry
+	record *idempotency.Record
+
+	size     int64
+	hits     uint64
+	lastUsed uint64
+	index    int
+}
+
+type attempt struct {
+	expiry
+	count int
+}
+
+// keyLock is the lock of a key, dropped once nobody holds or waits for it
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// newMemoryShard creates a shard with the given share of the store's bounds
+func newMemoryShard(maxEntries int, maxBytes int64, overflow OverflowPolicy, eviction EvictionPolicy) *memoryShard {
+	return &memoryShard{
+		data:       make(map[string]*entry),
+		attempts:   make(map[string]*attempt),
+		locks:      make(map[string]*keyLock),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		overflow:   overflow,
+		evictable:  evictionQueue{policy: eviction},
+	}
+}
+
+// stats returns the current usage of the shard
+func (sh *memoryShard) stats() MemoryStats {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return MemoryStats{
+		Entries:    len(sh.data),
+		Bytes:      sh.bytes,
+		Evictions:  sh.evictions,
+		Rejections: sh.rejections,
+	}
+}
+
+// Get retrieves a cached response
+func (sh *memoryShard) Get(key string) (*idempotency.CachedResponse, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	entry, exists := sh.data[key]
+	if !exists {
+		return nil, idempotency.ErrNotFound
+	}
+
+	if time.Now().After(entry.expiresAt) || entry.record.State != idempotency.StateCompleted {
+		return nil, idempotency.ErrNotFound
+	}
+	sh.touch(entry)
+
+	return entry.record.Response, nil
+}
+
+// Set stores a response with TTL
+func (sh *memoryShard) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if err := sh.admit(key, responseSize(response)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sh.set(key, &idempotency.Record{
+		Key:       key,
+		State:     idempotency.StateCompleted,
+		Response:  response,
+		StartedAt: now,
+		UpdatedAt: now,
+	}, now.Add(ttl))
+
+	return nil
+}
+
+// Begin creates a started record for key, or returns the current one
+func (sh *memoryShard) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	var prev *idempotency.Record
+	if e, exists := sh.data[key]; exists && now.Before(e.expiresAt) {
+		if e.record.State != idempotency.StateFailed {
+			sh.touch(e)
+			rec := *e.record
+			return &rec, false, nil
+		}
+		prev = e.record
+	}
+	if err := sh.admit(key, 0); err != nil {
+		return nil, false, err
+	}
+
+	return sh.start(key, owner, prev, now.Add(ttl)), true, nil
+}
+
+// Heartbeat refreshes the heartbeat of a started record owned by owner
+func (sh *memoryShard) Heartbeat(key string, owner idempotency.Owner) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, exists := sh.data[key]
+	if !exists || time.Now().After(e.expiresAt) {
+		return idempotency.ErrNotFound
+	}
+	if e.record.State != idempotency.StateStarted || !e.record.Owner.Equal(owner) {
+		return idempotency.ErrNotOwner
+	}
+
+	rec := *e.record
+	rec.HeartbeatAt = time.Now()
+	e.record = &rec
+
+	return nil
+}
+
+// Takeover replaces a stale started record with a new attempt owned by owner
+func (sh *memoryShard) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, exists := sh.data[key]
+	if !exists || time.Now().After(e.expiresAt) {
+		return nil, false, idempotency.ErrNotFound
+	}
+	if !sameAttempt(e.record, stale) {
+		rec := *e.record
+		return &rec, false, nil
+	}
+
+	return sh.start(key, owner, e.record, e.expiresAt), true, nil
+}
+
+// start stores the started record following prev and returns a copy of it.
+// The caller must hold sh.mu.
+func (sh *memoryShard) start(key string, owner idempotency.Owner, prev *idempotency.Record, expiresAt time.Time) *idempotency.Record {
+	rec := newStartedRecord(key, owner, prev)
+	sh.set(key, rec, expiresAt)
+
+	started := *rec
+	return &started
+}
+
+// Complete stores the response and marks the started record rec completed
+func (sh *memoryShard) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	e, exists := sh.data[key]
+	if !exists || now.After(e.expiresAt) {
+		return idempotency.ErrNotFound
+	}
+	if !completableBy(e.record, rec) {
+		return idempotency.ErrNotOwner
+	}
+
+	completed := *e.record
+	completed.State = idempotency.StateCompleted
+	completed.Response = response
+	completed.UpdatedAt = now
+	sh.set(key, &completed, now.Add(ttl))
+
+	return nil
+}
+
+// Fail marks the started record rec failed so the next Begin re-runs the request
+func (sh *memoryShard) Fail(key string, rec *idempotency.Record) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, exists := sh.data[key]
+	if !exists || time.Now().After(e.expiresAt) {
+		return idempotency.ErrNotFound
+	}
+	if !sameAttempt(e.record, rec) {
+		return idempotency.ErrNotOwner
+	}
+
+	failed := *e.record
+	failed.State = idempotency.StateFailed
+	failed.UpdatedAt = time.Now()
+	e.record = &failed
+	sh.evictable.push(e)
+
+	return nil
+}
+
+// IncrAttempt increments and returns the attempt count for key
+func (sh *memoryShard) IncrAttempt(key string, ttl time.Duration) (int, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	a, exists := sh.attempts[key]
+	if !exists || now.After(a.expiresAt) {
+		if exists {
+			sh.attemptExpiries.remove(&a.expiry)
+		}
+		a = &attempt{expiry: expiry{key: key}}
+		sh.attempts[key] = a
+		sh.attemptExpiries.push(&a.expiry)
+	}
+	a.count++
+	a.expiresAt = now.Add(ttl)
+	sh.attemptExpiries.fix(&a.expiry)
+
+	return a.count, nil
+}
+
+// LockFenced acquires a lock for the given key and returns its fencing token.
+// Tokens come from a counter shared by the keys of the shard, so they
+// increase for every key without keeping state for unlocked keys.
+func (sh *memoryShard) LockFenced(key string) (func(), uint64, error) {
+	sh.locksMu.Lock()
+	l, exists := sh.locks[key]
+	if !exists {
+		l = &keyLock{}
+		sh.locks[key] = l
+	}
+	l.refs++
+	sh.locksMu.Unlock()
+
+	// Try to acquire lock with timeout
+	locked := make(chan struct{})
+	go func() {
+		l.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		sh.locksMu.Lock()
+		sh.fence++
+		token := sh.fence
+		sh.locksMu.Unlock()
+		return func() { sh.unlock(key, l) }, token, nil
+	case <-time.After(100 * time.Millisecond):
+		// Release the lock as soon as the abandoned attempt gets it
+		go func() {
+			<-locked
+			sh.unlock(key, l)
+		}()
+		return nil, 0, idempotency.ErrRequestInProgress
+	}
+}
+
+// unlock releases the lock l of key, dropping it if nobody waits for it
+func (sh *memoryShard) unlock(key string, l *keyLock) {
+	sh.locksMu.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(sh.locks, key)
+	}
+	sh.locksMu.Unlock()
+
+	l.mu.Unlock()
+}
+
+// sweep removes the entries expired at now. Only expired entries are
+// visited, so the lock is held briefly even for large shards.
+func (sh *memoryShard) sweep(now time.Time) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for _, key := range sh.expiries.expired(now) {
+		sh.drop(key)
+	}
+	for _, key := range sh.attemptExpiries.expired(now) {
+		delete(sh.attempts, key)
+	}
+}
+
+// admit makes room for a new record of size bytes under key, or reports
+// ErrStoreFull. Replacing an existing record is always admitted.
+// The caller must hold sh.mu.
+func (sh *memoryShard) admit(key string, size int64) error {
+	if _, exists := sh.data[key]; exists || !sh.over(len(sh.data)+1, sh.bytes+size) {
+		return nil
+	}
+
+	if sh.overflow == OverflowEvict {
+		for sh.evictable.Len() > 0 && sh.over(len(sh.data)+1, sh.bytes+size) {
+			sh.evict(sh.evictable.pop())
+		}
+		if !sh.over(len(sh.data)+1, sh.bytes+size) {
+			return nil
+		}
+	}
+
+	sh.rejections++
+	return ErrStoreFull
+}
+
+// set stores rec under key until expiresAt, replacing the current record.
+// The caller must hold sh.mu.
+func (sh *memoryShard) set(key string, rec *idempotency.Record, expiresAt time.Time) {
+	e := &entry{expiry: expiry{key: key, expiresAt: expiresAt}, record: rec, index: -1}
+	if prev, exists := sh.data[key]; exists {
+		e.hits = prev.hits
+		sh.drop(key)
+	}
+	e.size = responseSize(rec.Response)
+
+	sh.data[key] = e
+	sh.bytes += e.size
+	sh.expiries.push(&e.expiry)
+	sh.touch(e)
+
+	// Make room for a grown response without evicting it right away
+	if sh.overflow == OverflowEvict {
+		for sh.evictable.Len() > 0 && sh.over(len(sh.data), sh.bytes) {
+			sh.evict(sh.evictable.pop())
+		}
+	}
+	if rec.State != idempotency.StateStarted {
+		sh.evictable.push(e)
+	}
+}
+
+// over reports whether the given usage exceeds the shard's bounds
+func (sh *memoryShard) over(entries int, bytes int64) bool {
+	return (sh.maxEntries > 0 && entries > sh.maxEntries) || (sh.maxBytes > 0 && bytes > sh.maxBytes)
+}
+
+// touch records a use of e. The caller must hold sh.mu.
+func (sh *memoryShard) touch(e *entry) {
+	sh.clock++
+	e.lastUsed = sh.clock
+	e.hits++
+	sh.evictable.fix(e)
+}
+
+// evict drops an entry to make room. The caller must hold sh.mu.
+func (sh *memoryShard) evict(e *entry) {
+	sh.drop(e.key)
+	sh.evictions++
+}
+
+// drop removes the record of key. The caller must hold sh.mu.
+func (sh *memoryShard) drop(key string) {
+	e, exists := sh.data[key]
+	if !exists {
+		return
+	}
+	delete(sh.data, key)
+	sh.bytes -= e.size
+	sh.evictable.remove(e)
+	sh.expiries.remove(&e.expiry)
+}
+
+// responseSize returns the number of body bytes a response takes
+func responseSize(response *idempotency.CachedResponse) int64 {
+	if response == nil {
+		return 0
+	}
+	return int64(len(response.Body))
+}
@@ -1,11 +1,14 @@
 package store
 
 import (
+	"fmt"
 	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,3 +73,295 @@ func TestMemoryStore_Lock(t *testing.T) {
 	require.NoError(t, err)
 	unlock2()
 }
+
+func TestMemoryStore_IncrAttempt(t *testing.T) {
+	store := NewMemoryStore()
+
+	n, err := store.IncrAttempt("test-key", 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = store.IncrAttempt("test-key", 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	time.Sleep(150 * time.Millisecond)
+
+	// Count restarts once expired
+	n, err = store.IncrAttempt("test-key", 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestMemoryStore_BeginExpires(t *testing.T) {
+	store := NewMemoryStore()
+	owner := idempotency.DefaultOwner()
+
+	_, started, err := store.Begin("test-key", owner, 100*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	_, err = store.Get("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+
+	time.Sleep(150 * time.Millisecond)
+
+	_, started, err = store.Begin("test-key", owner, 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, started)
+}
+
+func TestMemoryStore_FencingTokens(t *testing.T) {
+	store := NewMemoryStore()
+	owner := idempotency.DefaultOwner()
+
+	rec, _, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), rec.Token)
+
+	require.NoError(t, store.Fail("test-key", rec))
+	rec, _, err = store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), rec.Token)
+
+	rec, _, err = store.Takeover("test-key", rec, owner)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), rec.Token)
+
+	unlock, token1, err := store.LockFenced("lock-key")
+	require.NoError(t, err)
+	unlock()
+
+	unlock, token2, err := store.LockFenced("lock-key")
+	require.NoError(t, err)
+	unlock()
+	assert.Greater(t, token2, token1)
+
+	// Released locks don't stay behind
+	assert.Empty(t, store.shards[0].locks)
+}
+
+func TestMemoryStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStore(WithMaxEntries(2))
+	response := &idempotency.CachedResponse{StatusCode: 200}
+
+	require.NoError(t, store.Set("key-a", response, time.Hour))
+	require.NoError(t, store.Set("key-b", response, time.Hour))
+	_, err := store.Get("key-a")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("key-c", response, time.Hour))
+
+	_, err = store.Get("key-b")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+	_, err = store.Get("key-a")
+	assert.NoError(t, err)
+	assert.Equal(t, MemoryStats{Entries: 2, Evictions: 1}, store.Stats())
+}
+
+func TestMemoryStore_EvictsLeastFrequentlyUsed(t *testing.T) {
+	store := NewMemoryStore(WithMaxEntries(2), WithEvictionPolicy(EvictLFU))
+	response := &idempotency.CachedResponse{StatusCode: 200}
+
+	require.NoError(t, store.Set("key-a", response, time.Hour))
+	require.NoError(t, store.Set("key-b", response, time.Hour))
+	for i := 0; i < 3; i++ {
+		_, err := store.Get("key-a")
+		require.NoError(t, err)
+	}
+	_, err := store.Get("key-b")
+	require.NoError(t, err)
+	require.NoError(t, store.Set("key-c", response, time.Hour))
+
+	// key-b was used last, but less often than key-a
+	_, err = store.Get("key-b")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+	_, err = store.Get("key-a")
+	assert.NoError(t, err)
+}
+
+func TestMemoryStore_MaxBytes(t *testing.T) {
+	store := NewMemoryStore(WithMaxBytes(10))
+
+	require.NoError(t, store.Set("key-a", &idempotency.CachedResponse{Body: []byte("123456")}, time.Hour))
+	require.NoError(t, store.Set("key-b", &idempotency.CachedResponse{Body: []byte("123456")}, time.Hour))
+
+	_, err := store.Get("key-a")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+	assert.Equal(t, MemoryStats{Entries: 1, Bytes: 6, Evictions: 1}, store.Stats())
+}
+
+func TestMemoryStore_OverflowReject(t *testing.T) {
+	store := NewMemoryStore(WithMaxEntries(1), WithOverflowPolicy(OverflowReject))
+	owner := idempotency.DefaultOwner()
+
+	require.NoError(t, store.Set("key-a", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+
+	_, _, err := store.Begin("key-b", owner, time.Hour)
+	assert.ErrorIs(t, err, ErrStoreFull)
+
+	// Existing records are still served
+	rec, started, err := store.Begin("key-a", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateCompleted, rec.State)
+	assert.Equal(t, MemoryStats{Entries: 1, Rejections: 1}, store.Stats())
+}
+
+func TestMemoryStore_KeepsStartedRecords(t *testing.T) {
+	store := NewMemoryStore(WithMaxEntries(1), WithMaxBytes(4))
+	owner := idempotency.DefaultOwner()
+
+	rec, started, err := store.Begin("key-a", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	// The running request can't be evicted
+	_, _, err = store.Begin("key-b", owner, time.Hour)
+	assert.ErrorIs(t, err, ErrStoreFull)
+
+	// Completing is accepted even over the byte budget
+	require.NoError(t, store.Complete("key-a", rec, &idempotency.CachedResponse{Body: []byte("123456")}, time.Hour))
+	_, err = store.Get("key-a")
+	require.NoError(t, err)
+
+	// Once completed, it makes room for new records
+	_, started, err = store.Begin("key-b", owner, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, started)
+	assert.Equal(t, MemoryStats{Entries: 1, Evictions: 1, Rejections: 1}, store.Stats())
+}
+
+func TestMemoryStore_SweepsExpired(t *testing.T) {
+	store := NewMemoryStore(WithCleanupInterval(10 * time.Millisecond))
+	t.Cleanup(func() { store.Close() })
+
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte("123")}
+	require.NoError(t, store.Set("short", response, 20*time.Millisecond))
+	require.NoError(t, store.Set("long", response, time.Hour))
+	_, err := store.IncrAttempt("short", 20*time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return store.Stats().Entries == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(3), store.Stats().Bytes)
+
+	// The attempt counter was swept as well
+	n, err := store.IncrAttempt("short", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestMemoryStore_Close(t *testing.T) {
+	store := NewMemoryStore(WithCleanupInterval(10 * time.Millisecond))
+	require.NoError(t, store.Close())
+	require.NoError(t, store.Close())
+
+	require.NoError(t, store.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	// Nothing is swept once closed, but expired records stay hidden
+	assert.Equal(t, 1, store.Stats().Entries)
+	_, err := store.Get("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func TestMemoryStore_Shards(t *testing.T) {
+	store := NewMemoryStore(WithShards(8))
+	owner := idempotency.DefaultOwner()
+
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		rec, started, err := store.Begin(key, owner, time.Hour)
+		require.NoError(t, err)
+		require.True(t, started)
+		require.NoError(t, store.Complete(key, rec, &idempotency.CachedResponse{StatusCode: 200, Body: []byte("1")}, time.Hour))
+	}
+
+	for i := 0; i < 40; i++ {
+		rec, started, err := store.Begin(fmt.Sprintf("key-%d", i), owner, time.Hour)
+		require.NoError(t, err)
+		assert.False(t, started)
+		assert.Equal(t, idempotency.StateCompleted, rec.State)
+	}
+
+	assert.Equal(t, MemoryStats{Entries: 40, Bytes: 40}, store.Stats())
+}
+
+func TestMemoryStore_ShardsSplitBounds(t *testing.T) {
+	store := NewMemoryStore(WithShards(4), WithMaxEntries(4))
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key-%d", i), &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+	}
+
+	stats := store.Stats()
+	assert.LessOrEqual(t, stats.Entries, 4)
+	assert.Equal(t, uint64(100-stats.Entries), stats.Evictions)
+}
+
+func TestMemoryStore_ShardsSplitBoundsExactly(t *testing.T) {
+	store := NewMemoryStore(WithShards(4), WithMaxEntries(10), WithMaxBytes(2))
+	assert.Len(t, store.shards, 2)
+
+	var entries int
+	var bytes int64
+	for _, sh := range store.shards {
+		entries += sh.maxEntries
+		bytes += sh.maxBytes
+	}
+	assert.Equal(t, 10, entries)
+	assert.Equal(t, int64(2), bytes)
+}
+
+func benchmarkMemoryStore(b *testing.B, op func(store *MemoryStore, key string)) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			store := NewMemoryStore(WithShards(shards))
+			defer store.Close()
+
+			response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+			for i := 0; i < 1024; i++ {
+				store.Set(fmt.Sprintf("key-%d", i), response, time.Hour)
+			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				id := next.Add(1)
+				for i := 0; pb.Next(); i++ {
+					op(store, fmt.Sprintf("key-%d", (int(id)*7919+i)%1024))
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemoryStore_Get(b *testing.B) {
+	benchmarkMemoryStore(b, func(store *MemoryStore, key string) {
+		store.Get(key)
+	})
+}
+
+func BenchmarkMemoryStore_Set(b *testing.B) {
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+	benchmarkMemoryStore(b, func(store *MemoryStore, key string) {
+		store.Set(key, response, time.Hour)
+	})
+}
+
+func BenchmarkMemoryStore_Lock(b *testing.B) {
+	benchmarkMemoryStore(b, func(store *MemoryStore, key string) {
+		if unlock, err := store.Lock(key); err == nil {
+			unlock()
+		}
+	})
+}
+
+func TestMemoryStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		store := NewMemoryStore()
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS {{table}} (
+	id           CHAR(64)    NOT NULL PRIMARY KEY,
+	state        VARCHAR(16) NOT NULL,
+	attempt      INT         NOT NULL,
+	token        BIGINT      NOT NULL,
+	version      BIGINT      NOT NULL,
+	owner        TEXT        NOT NULL,
+	started_at   BIGINT      NOT NULL,
+	heartbeat_at BIGINT      NOT NULL,
+	updated_at   BIGINT      NOT NULL,
+	expires_at   BIGINT      NOT NULL,
+	response     LONGBLOB,
+	INDEX {{table}}_expires_at (expires_at)
+);
+
+CREATE TABLE IF NOT EXISTS {{table}}_locks (
+	id         CHAR(64) NOT NULL PRIMARY KEY,
+	token      BIGINT   NOT NULL,
+	expires_at BIGINT   NOT NULL
+);
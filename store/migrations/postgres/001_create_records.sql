@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS {{table}} (
+	id           CHAR(64)    PRIMARY KEY,
+	state        VARCHAR(16) NOT NULL,
+	attempt      INTEGER     NOT NULL,
+	token        BIGINT      NOT NULL,
+	version      BIGINT      NOT NULL,
+	owner        TEXT        NOT NULL,
+	started_at   BIGINT      NOT NULL,
+	heartbeat_at BIGINT      NOT NULL,
+	updated_at   BIGINT      NOT NULL,
+	expires_at   BIGINT      NOT NULL,
+	response     BYTEA
+);
+
+CREATE INDEX IF NOT EXISTS {{table}}_expires_at ON {{table}} (expires_at);
+
+CREATE TABLE IF NOT EXISTS {{table}}_locks (
+	id         CHAR(64) PRIMARY KEY,
+	token      BIGINT   NOT NULL,
+	expires_at BIGINT   NOT NULL
+);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS {{table}} (
+	id           TEXT    PRIMARY KEY,
+	state        TEXT    NOT NULL,
+	attempt      INTEGER NOT NULL,
+	token        INTEGER NOT NULL,
+	version      INTEGER NOT NULL,
+	owner        TEXT    NOT NULL,
+	started_at   INTEGER NOT NULL,
+	heartbeat_at INTEGER NOT NULL,
+	updated_at   INTEGER NOT NULL,
+	expires_at   INTEGER NOT NULL,
+	response     BLOB
+);
+
+CREATE INDEX IF NOT EXISTS {{table}}_expires_at ON {{table}} (expires_at);
+
+CREATE TABLE IF NOT EXISTS {{table}}_locks (
+	id         TEXT    PRIMARY KEY,
+	token      INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisOption is a functional option for configuring a RedisStore
+type RedisOption func(*RedisStore)
+
+// WithKeyPrefix prefixes every key the store writes, e.g. "payments:idem:".
+// It panics if prefix contains braces, which would break the hash tags.
+func WithKeyPrefix(prefix string) RedisOption {
+	if strings.ContainsAny(prefix, "{}") {
+		panic(fmt.Sprintf("store: key prefix %q contains braces", prefix))
+	}
+	return func(s *RedisStore) {
+		s.keyPrefix = prefix
+	}
+}
+
+// WithLockPrefix sets the prefix telling lock keys apart from record keys,
+// "lock:" by default. It panics if prefix is empty, contains braces or is
+// the prefix of the store's counters, since lock keys would then collide
+// with other keys.
+func WithLockPrefix(prefix string) RedisOption {
+	if prefix == "" || strings.ContainsAny(prefix, "{}") || prefix == fencePrefix || prefix == attemptsPrefix {
+		panic(fmt.Sprintf("store: invalid lock prefix %q", prefix))
+	}
+	return func(s *RedisStore) {
+		s.lockPrefix = prefix
+	}
+}
+
+// WithHashedKeys replaces store keys longer than maxLen with their SHA-256,
+// so long client-supplied keys take a fixed amount of space
+func WithHashedKeys(maxLen int) RedisOption {
+	return func(s *RedisStore) {
+		s.hashKeysOver = maxLen
+	}
+}
+
+// WithNamespaceVersion adds a version to every key. Bumping it makes the store
+// ignore all records written under the previous version, which then expire.
+func WithNamespaceVersion(version int) RedisOption {
+	return func(s *RedisStore) {
+		s.namespace = "v" + strconv.Itoa(version) + ":"
+	}
+}
+
+// WithLegacyKeys makes the store fall back to records written by earlier
+// versions under the untagged keys <prefix><namespace><key> until the given
+// time, which should be the upgrade plus the longest TTL. Completed legacy
+// records are replayed and copied to the current layout; requests those
+// versions still had in progress are not seen, so drain them before
+// upgrading. Meanwhile starting a new key takes two round trips.
+func WithLegacyKeys(until time.Time) RedisOption {
+	return func(s *RedisStore) {
+		s.legacyUntil = until
+	}
+}
+
+// WithCodec sets the codec used to encode stored responses, DefaultCodec by default
+func WithCodec(codec Codec) RedisOption {
+	return func(s *RedisStore) {
+		s.codec = codec
+	}
+}
+
+// WithCompression compresses stored response bodies of at least minSize bytes with c
+func WithCompression(c Compressor, minSize int) RedisOption {
+	return func(s *RedisStore) {
+		s.compressor = c
+		s.compressMinSize = minSize
+	}
+}
+
+// TieredOption is a functional option for configuring a TieredStore
+type TieredOption func(*TieredStore)
+
+// WithL1Size sets the number of records kept in memory, DefaultL1Size by
+// default. Zero disables L1.
+func WithL1Size(n int) TieredOption {
+	return func(s *TieredStore) {
+		s.maxSize = n
+	}
+}
+
+// WithL1TTL sets the longest time a record is kept in memory, DefaultL1TTL by default
+func WithL1TTL(ttl time.Duration) TieredOption {
+	return func(s *TieredStore) {
+		s.ttl = ttl
+	}
+}
+
+// MemoryOption is a functional option for configuring a MemoryStore
+type MemoryOption func(*MemoryStore)
+
+// WithMaxEntries bounds the number of records a MemoryStore keeps
+func WithMaxEntries(n int) MemoryOption {
+	return func(s *MemoryStore) {
+		s.maxEntries = n
+	}
+}
+
+// WithMaxBytes bounds the total size of the response bodies a MemoryStore keeps
+func WithMaxBytes(n int64) MemoryOption {
+	return func(s *MemoryStore) {
+		s.maxBytes = n
+	}
+}
+
+// WithEvictionPolicy sets which records are evicted first, EvictLRU by default
+func WithEvictionPolicy(policy EvictionPolicy) MemoryOption {
+	return func(s *MemoryStore) {
+		s.eviction = policy
+	}
+}
+
+// WithOverflowPolicy sets what happens to new records once the store is full,
+// OverflowEvict by default
+func WithOverflowPolicy(policy OverflowPolicy) MemoryOption {
+	return func(s *MemoryStore) {
+		s.overflow = policy
+	}
+}
+
+// WithCleanupInterval sets the interval between sweeps of expired records,
+// DefaultCleanupInterval by default. Zero disables the background sweep.
+func WithCleanupInterval(interval time.Duration) MemoryOption {
+	return func(s *MemoryStore) {
+		s.cleanupInterval = interval
+	}
+}
+
+// WithShards spreads keys over n independently locked shards, 1 by default.
+// More shards lower lock contention under concurrent load. The bounds of
+// the store are split over the shards, so a full shard evicts or rejects
+// before the store as a whole is full; there are never more shards than
+// the smallest bound.
+func WithShards(n int) MemoryOption {
+	return func(s *MemoryStore) {
+		s.shardCount = n
+	}
+}
+
+// WithSnapshot saves the records of the store to path every interval and on
+// Close. Zero interval only saves on Close. Load the snapshot at startup
+// with LoadSnapshot.
+func WithSnapshot(path string, interval time.Duration) MemoryOption {
+	return func(s *MemoryStore) {
+		s.snapshotPath = path
+		s.snapshotInterval = interval
+	}
+}
+
+// FileOption is a functional option for configuring a FileStore
+type FileOption func(*FileStore)
+
+// WithSweepInterval sets the interval between sweeps of expired files,
+// DefaultCleanupInterval by default. Zero disables the background sweep.
+func WithSweepInterval(interval time.Duration) FileOption {
+	return func(s *FileStore) {
+		s.sweepInterval = interval
+	}
+}
+
+// SQLOption is a functional option for configuring a SQLStore
+type SQLOption func(*SQLStore)
+
+// WithTableName sets the table of records, DefaultTableName by default.
+// Locks and applied migrations are kept in tables named after it with the
+// suffixes _locks and _schema. name is used in SQL as is and must be trusted.
+func WithTableName(name string) SQLOption {
+	return func(s *SQLStore) {
+		s.table = name
+	}
+}
+
+// FaultOption is a functional option for configuring a FaultStore
+type FaultOption func(*FaultStore)
+
+// WithFaultScript gives the first calls of op the faults in order;
+// later calls pass through
+func WithFaultScript(op Op, faults ...Fault) FaultOption {
+	return func(s *FaultStore) {
+		s.scripts[op] = faults
+	}
+}
+
+// WithFaultRate injects f into calls of op with the given probability
+func WithFaultRate(op Op, probability float64, f Fault) FaultOption {
+	return func(s *FaultStore) {
+		s.rates[op] = append(s.rates[op], faultRate{probability: probability, fault: f})
+	}
+}
+
+// WithFaultSeed seeds the random choice of faults, making runs repeatable
+func WithFaultSeed(seed int64) FaultOption {
+	return func(s *FaultStore) {
+		s.rng = rand.New(rand.NewSource(seed))
+	}
+}
+
+// EncryptedOption is a functional option for configuring an EncryptedStore
+type EncryptedOption func(*EncryptedStore)
+
+// WithPlaintextUntil replays responses stored before encryption was enabled
+// until the given time, which should be the switch plus the longest TTL.
+// Meanwhile anyone able to write to the wrapped store can plant a plaintext
+// response that is replayed as is.
+func WithPlaintextUntil(until time.Time) EncryptedOption {
+	return func(s *EncryptedStore) {
+		s.plaintextUntil = until
+	}
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// newStartedRecord returns a started record for the attempt following prev,
+// owned by owner. prev is nil for the first attempt.
+func newStartedRecord(key string, owner idempotency.Owner, prev *idempotency.Record) *idempotency.Record {
+	var attempt int
+	var token uint64
+	if prev != nil {
+		attempt, token = prev.Attempt, prev.Token
+	}
+
+	now := time.Now()
+	return &idempotency.Record{
+		Key:         key,
+		State:       idempotency.StateStarted,
+		Attempt:     attempt + 1,
+		Token:       token + 1,
+		Owner:       owner,
+		StartedAt:   now,
+		HeartbeatAt: now,
+		UpdatedAt:   now,
+	}
+}
+
+// sameAttempt reports whether current is still the started attempt read as stale
+func sameAttempt(current, stale *idempotency.Record) bool {
+	return current.State == idempotency.StateStarted && isAttempt(current, stale)
+}
+
+// completableBy reports whether the attempt rec may complete current: current
+// is still that attempt, started or already completed by it
+func completableBy(current, rec *idempotency.Record) bool {
+	return (current.State == idempotency.StateStarted || current.State == idempotency.StateCompleted) &&
+		isAttempt(current, rec)
+}
+
+// isAttempt reports whether current and rec are the same attempt
+func isAttempt(current, rec *idempotency.Record) bool {
+	return current.Attempt == rec.Attempt && current.Owner.Equal(rec.Owner)
+}
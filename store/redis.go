@@ -2,70 +2,448 @@ package store
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"time"
 
 	"github.com/AnandSundar/go-idempotency"
 	"github.com/redis/go-redis/v9"
 )
 
-// RedisStore is a Redis-backed implementation of Store
+// Prefixes telling the counter keys of a record apart
+const (
+	fencePrefix    = "fence:"
+	attemptsPrefix = "attempts:"
+)
+
+// RedisStore is a Redis-backed implementation of Store.
+// Records are kept as hashes and every operation is a single server-side
+// script call, so starting a request and completing it cost one round trip each.
+//
+// All keys derived from one store key share a hash tag, so they land in the
+// same slot and scripts touching several of them work on Redis Cluster.
 type RedisStore struct {
-	client *redis.Client
+	client redis.UniversalClient
 	ctx    context.Context
+	codec  Codec
+
+	compressor      Compressor
+	compressMinSize int
+
+	keyPrefix    string
+	lockPrefix   string
+	namespace    string
+	hashKeysOver int
+	legacyUntil  time.Time
 }
 
-// NewRedisStore creates a new Redis store
-func NewRedisStore(client *redis.Client) *RedisStore {
-	return &RedisStore{
-		client: client,
-		ctx:    context.Background(),
+// NewRedisStore creates a new Redis store. client may be a *redis.Client,
+// a *redis.ClusterClient, a Sentinel-backed failover client or a ring.
+//
+// Keys are laid out as <prefix><namespace><kind>{<key>}, where kind is empty
+// for records and the lock prefix for locks. Completed records written by
+// earlier versions under untagged keys can be replayed during an upgrade,
+// see WithLegacyKeys.
+func NewRedisStore(client redis.UniversalClient, opts ...RedisOption) *RedisStore {
+	s := &RedisStore{
+		client:       client,
+		ctx:          context.Background(),
+		codec:        DefaultCodec,
+		lockPrefix:   "lock:",
+		hashKeysOver: -1,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.compressor != nil {
+		s.codec = NewCompressingCodec(s.codec, s.compressor, s.compressMinSize)
 	}
+
+	return s
 }
 
 // Get retrieves a cached response from Redis
 func (s *RedisStore) Get(key string) (*idempotency.CachedResponse, error) {
-	data, err := s.client.Get(s.ctx, key).Bytes()
-	if err == redis.Nil {
-		return nil, idempotency.ErrNotFound
-	}
+	res, err := getScript.Run(s.ctx, s.client, []string{s.recordKey(key)}).Slice()
 	if err != nil {
 		return nil, err
 	}
 
-	var response idempotency.CachedResponse
-	if err := json.Unmarshal(data, &response); err != nil {
+	rec, err := s.parseRecord(key, res)
+	if err == idempotency.ErrNotFound && s.legacyKeys() {
+		rec, _, err = s.readLegacy(key)
+	}
+	if err != nil {
 		return nil, err
 	}
+	if rec.State != idempotency.StateCompleted {
+		return nil, idempotency.ErrNotFound
+	}
 
-	return &response, nil
+	return rec.Response, nil
 }
 
 // Set stores a response in Redis with TTL
 func (s *RedisStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
-	data, err := json.Marshal(response)
+	data, err := s.encodeResponse(key, response)
+	if err != nil {
+		return err
+	}
+
+	return setScript.Run(s.ctx, s.client, []string{s.recordKey(key)}, data, formatTime(time.Now()), ttl.Milliseconds()).Err()
+}
+
+// Begin creates a started record for key, or returns the current one
+func (s *RedisStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	ownerData, err := json.Marshal(owner)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := beginScript.Run(s.ctx, s.client, []string{s.recordKey(key)}, ownerData, formatTime(time.Now()), ttl.Milliseconds()).Slice()
+	if err != nil {
+		return nil, false, err
+	}
+
+	rec, started, err := s.parseStartResult(key, res)
+	if err != nil || !started || !s.legacyKeys() {
+		return rec, started, err
+	}
+	return s.adoptLegacy(key, rec, ttl)
+}
+
+// adoptLegacy completes the record rec just started with the response of a
+// completed legacy record of key, if there is one. The legacy record is then
+// returned in place of rec.
+func (s *RedisStore) adoptLegacy(key string, rec *idempotency.Record, ttl time.Duration) (*idempotency.Record, bool, error) {
+	legacy, pttl, err := s.readLegacy(key)
+	if err == idempotency.ErrNotFound || (err == nil && legacy.State != idempotency.StateCompleted) {
+		return rec, true, nil
+	}
+	if err != nil {
+		// Don't run the request again while it can't be told whether it ran
+		s.Fail(key, rec)
+		return nil, false, err
+	}
+
+	if pttl > 0 {
+		ttl = pttl
+	}
+	if err := s.Complete(key, rec, legacy.Response, ttl); err != nil && err != idempotency.ErrNotOwner {
+		return nil, false, err
+	}
+
+	return legacy, false, nil
+}
+
+// legacyKeys reports whether the store still falls back to legacy records
+func (s *RedisStore) legacyKeys() bool {
+	return time.Now().Before(s.legacyUntil)
+}
+
+// readLegacy reads the record of key written under the untagged layout of
+// earlier versions and returns it with its remaining TTL, 0 if it has none
+func (s *RedisStore) readLegacy(key string) (*idempotency.Record, time.Duration, error) {
+	res, err := legacyScript.Run(s.ctx, s.client, []string{s.keyPrefix + s.namespace + key}).Slice()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(res) != 3 {
+		return nil, 0, errUnexpectedReply
+	}
+
+	rec, err := s.parseRecord(key, res[:2])
+	if err != nil {
+		// Not a record, the key belongs to someone else
+		return nil, 0, idempotency.ErrNotFound
+	}
+	pttl, _ := res[2].(int64)
+	if pttl < 0 {
+		pttl = 0
+	}
+
+	return rec, time.Duration(pttl) * time.Millisecond, nil
+}
+
+// Heartbeat refreshes the heartbeat of a started record owned by owner
+func (s *RedisStore) Heartbeat(key string, owner idempotency.Owner) error {
+	ownerData, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+
+	n, err := heartbeatScript.Run(s.ctx, s.client, []string{s.recordKey(key)}, ownerData, formatTime(time.Now())).Int()
+	if err != nil {
+		return err
+	}
+	return ownedResult(n)
+}
+
+// Takeover replaces a stale started record with a new attempt owned by owner
+func (s *RedisStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	ownerData, err := json.Marshal(owner)
+	if err != nil {
+		return nil, false, err
+	}
+	staleOwnerData, err := json.Marshal(stale.Owner)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := takeoverScript.Run(s.ctx, s.client, []string{s.recordKey(key)},
+		ownerData, formatTime(time.Now()), stale.Attempt, staleOwnerData).Slice()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return s.parseStartResult(key, res)
+}
+
+// Complete stores the response and marks the started record rec completed.
+// The response is stored as a completed record encoded with the store's codec.
+func (s *RedisStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	data, err := s.encodeResponse(key, response)
+	if err != nil {
+		return err
+	}
+	ownerData, err := json.Marshal(rec.Owner)
 	if err != nil {
 		return err
 	}
 
-	return s.client.Set(s.ctx, key, data, ttl).Err()
+	n, err := completeScript.Run(s.ctx, s.client, []string{s.recordKey(key)},
+		data, formatTime(time.Now()), ttl.Milliseconds(), rec.Attempt, ownerData).Int()
+	if err != nil {
+		return err
+	}
+	return ownedResult(n)
+}
+
+// Fail marks the started record rec failed so the next Begin re-runs the
+// request. The record keeps its remaining TTL.
+func (s *RedisStore) Fail(key string, rec *idempotency.Record) error {
+	ownerData, err := json.Marshal(rec.Owner)
+	if err != nil {
+		return err
+	}
+
+	n, err := failScript.Run(s.ctx, s.client, []string{s.recordKey(key)},
+		formatTime(time.Now()), rec.Attempt, ownerData).Int()
+	if err != nil {
+		return err
+	}
+	return ownedResult(n)
+}
+
+// IncrAttempt increments and returns the attempt count for key
+func (s *RedisStore) IncrAttempt(key string, ttl time.Duration) (int, error) {
+	attemptKey := s.attemptKey(key)
+
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(s.ctx, attemptKey)
+	pipe.Expire(s.ctx, attemptKey, ttl)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return 0, err
+	}
+
+	return int(incr.Val()), nil
 }
 
 // Lock acquires a distributed lock using Redis
 func (s *RedisStore) Lock(key string) (func(), error) {
-	lockKey := "lock:" + key
-	acquired, err := s.client.SetNX(s.ctx, lockKey, "1", 30*time.Second).Result()
+	unlock, _, err := s.LockFenced(key)
+	return unlock, err
+}
+
+// LockFenced acquires a distributed lock using Redis and returns its fencing token.
+// Tokens come from a per-key counter kept for DefaultTTL after the last lock.
+func (s *RedisStore) LockFenced(key string) (func(), uint64, error) {
+	lockKey := s.lockKey(key)
+	fenceKey := s.fenceKey(key)
+
+	token, err := lockScript.Run(s.ctx, s.client, []string{lockKey, fenceKey},
+		(30 * time.Second).Milliseconds(), idempotency.DefaultTTL.Milliseconds()).Int64()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	if !acquired {
-		return nil, idempotency.ErrRequestInProgress
+	if token == 0 {
+		return nil, 0, idempotency.ErrRequestInProgress
 	}
 
 	unlock := func() {
-		s.client.Del(s.ctx, lockKey)
+		// Only release the lock if it wasn't taken over after expiring
+		unlockScript.Run(s.ctx, s.client, []string{lockKey}, token)
+	}
+
+	return unlock, uint64(token), nil
+}
+
+// recordKey returns the Redis key of the record of key
+func (s *RedisStore) recordKey(key string) string {
+	return s.redisKey("", key)
+}
+
+// lockKey returns the Redis key of the lock of key
+func (s *RedisStore) lockKey(key string) string {
+	return s.redisKey(s.lockPrefix, key)
+}
+
+// fenceKey returns the Redis key of the fencing token counter of key
+func (s *RedisStore) fenceKey(key string) string {
+	return s.redisKey(fencePrefix, key)
+}
+
+// attemptKey returns the Redis key of the attempt counter of key
+func (s *RedisStore) attemptKey(key string) string {
+	return s.redisKey(attemptsPrefix, key)
+}
+
+// redisKey lays out the Redis key of the given kind for key
+func (s *RedisStore) redisKey(kind, key string) string {
+	if s.hashKeysOver >= 0 && len(key) > s.hashKeysOver {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return s.keyPrefix + s.namespace + kind + hashTag(key)
+}
+
+// hashTag wraps key in braces so Redis Cluster hashes only key itself.
+// Keys containing braces still map all derived keys to one slot, since
+// the tag always starts at the brace added here.
+func hashTag(key string) string {
+	return "{" + key + "}"
+}
+
+// encodeResponse encodes response as a completed record with the store's codec
+func (s *RedisStore) encodeResponse(key string, response *idempotency.CachedResponse) ([]byte, error) {
+	return s.codec.Marshal(&idempotency.Record{
+		Key:      key,
+		State:    idempotency.StateCompleted,
+		Response: response,
+	})
+}
+
+// ownedResult converts the reply of a script checking the owner of a record
+func ownedResult(n int) error {
+	switch n {
+	case scriptNotFound:
+		return idempotency.ErrNotFound
+	case 0:
+		return idempotency.ErrNotOwner
+	}
+	return nil
+}
+
+// formatTime formats a record timestamp for storage
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+// parseStartResult parses the {started, kind, value} reply of a script
+// starting a record
+func (s *RedisStore) parseStartResult(key string, res []interface{}) (*idempotency.Record, bool, error) {
+	if len(res) != 3 {
+		return nil, false, errUnexpectedReply
+	}
+	if n, _ := res[0].(int64); n == scriptNotFound {
+		return nil, false, idempotency.ErrNotFound
+	}
+
+	rec, err := s.parseRecord(key, res[1:])
+	if err != nil {
+		return nil, false, err
+	}
+
+	return rec, res[0] == int64(1), nil
+}
+
+// parseRecord parses the {kind, value} reply of a script reading a record
+func (s *RedisStore) parseRecord(key string, res []interface{}) (*idempotency.Record, error) {
+	if len(res) != 2 {
+		return nil, errUnexpectedReply
+	}
+
+	switch res[0] {
+	case "none":
+		return nil, idempotency.ErrNotFound
+	case "legacy":
+		data, _ := res[1].(string)
+		rec, err := decodeRecord([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		rec.Key = key
+		return rec, nil
+	case "record":
+		fields, _ := res[1].([]interface{})
+		return s.parseRecordFields(key, fields)
+	}
+
+	return nil, errUnexpectedReply
+}
+
+// parseRecordFields parses the HGETALL reply of a record hash
+func (s *RedisStore) parseRecordFields(key string, fields []interface{}) (*idempotency.Record, error) {
+	rec := &idempotency.Record{Key: key}
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+
+		var err error
+		switch name {
+		case "state":
+			rec.State = idempotency.RecordState(value)
+		case "attempt":
+			rec.Attempt, err = strconv.Atoi(value)
+		case "token":
+			rec.Token, err = strconv.ParseUint(value, 10, 64)
+		case "owner":
+			err = json.Unmarshal([]byte(value), &rec.Owner)
+		case "started_at":
+			rec.StartedAt, err = time.Parse(time.RFC3339Nano, value)
+		case "heartbeat_at":
+			rec.HeartbeatAt, err = time.Parse(time.RFC3339Nano, value)
+		case "updated_at":
+			rec.UpdatedAt, err = time.Parse(time.RFC3339Nano, value)
+		case "response":
+			var completed *idempotency.Record
+			if completed, err = s.codec.Unmarshal([]byte(value)); err == nil {
+				rec.Response = completed.Response
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rec, nil
+}
+
+// decodeRecord decodes a record stored as a plain string value by earlier
+// versions. Such values were written as JSON records, or as bare
+// CachedResponses before records existed, which are read as completed records.
+func decodeRecord(data []byte) (*idempotency.Record, error) {
+	var rec idempotency.Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.State != "" {
+		return &rec, nil
+	}
+
+	var response idempotency.CachedResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
 	}
 
-	return unlock, nil
+	return &idempotency.Record{
+		State:     idempotency.StateCompleted,
+		Response:  &response,
+		StartedAt: response.Timestamp,
+		UpdatedAt: response.Timestamp,
+	}, nil
 }
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptNotFound is returned by scripts when the record doesn't exist
+const scriptNotFound = -1
+
+// errUnexpectedReply is returned when a script replies in an unknown shape
+var errUnexpectedReply = errors.New("unexpected reply from redis script")
+
+// readRecord is shared by the scripts reading a record. It replies
+// {"record", fields} for record hashes and {"none", false} otherwise.
+const readRecord = `
+local function read(key)
+	if redis.call("TYPE", key).ok == "hash" then
+		return {"record", redis.call("HGETALL", key)}
+	end
+	return {"none", false}
+end
+`
+
+// legacyScript reads the record at KEYS[1] written by versions before hash
+// tagged keys. It replies {"record", fields, pttl} for record hashes,
+// {"legacy", value, pttl} for plain string values and {"none", false, -2}
+// otherwise.
+var legacyScript = redis.NewScript(`
+local kind = redis.call("TYPE", KEYS[1]).ok
+if kind == "hash" then
+	return {"record", redis.call("HGETALL", KEYS[1]), redis.call("PTTL", KEYS[1])}
+elseif kind == "string" then
+	return {"legacy", redis.call("GET", KEYS[1]), redis.call("PTTL", KEYS[1])}
+end
+return {"none", false, -2}
+`)
+
+// getScript reads the record at KEYS[1]
+var getScript = redis.NewScript(readRecord + `
+return read(KEYS[1])
+`)
+
+// startRecord replaces the record at key with a started record for the next
+// attempt. ARGV holds the owner, the current time and optionally a TTL in ms.
+const startRecord = `
+local function start(key, owner, now, ttl)
+	local attempt = 0
+	local token = 0
+	if redis.call("TYPE", key).ok == "hash" then
+		attempt = tonumber(redis.call("HGET", key, "attempt") or "0")
+		token = tonumber(redis.call("HGET", key, "token") or "0")
+	end
+
+	local pttl = redis.call("PTTL", key)
+	redis.call("DEL", key)
+	redis.call("HSET", key,
+		"state", "started",
+		"attempt", attempt + 1,
+		"token", token + 1,
+		"owner", owner,
+		"started_at", now,
+		"heartbeat_at", now,
+		"updated_at", now)
+	if ttl then
+		redis.call("PEXPIRE", key, ttl)
+	elseif pttl > 0 then
+		redis.call("PEXPIRE", key, pttl)
+	end
+	return {1, "record", redis.call("HGETALL", key)}
+end
+`
+
+// beginScript starts a record at KEYS[1] unless one that isn't failed exists,
+// in which case it is returned. ARGV: owner, now, ttl in ms.
+var beginScript = redis.NewScript(readRecord + startRecord + `
+local current = read(KEYS[1])
+if current[1] == "record" and redis.call("HGET", KEYS[1], "state") ~= "failed" then
+	return {0, current[1], current[2]}
+end
+return start(KEYS[1], ARGV[1], ARGV[2], ARGV[3])
+`)
+
+// takeoverScript starts a new attempt at KEYS[1] if the record is still the
+// started attempt ARGV[3] owned by ARGV[4], keeping its TTL. ARGV: owner, now,
+// stale attempt, stale owner.
+var takeoverScript = redis.NewScript(readRecord + startRecord + `
+local current = read(KEYS[1])
+if current[1] == "none" then
+	return {-1, "none", false}
+end
+
+local state, attempt, owner = unpack(redis.call("HMGET", KEYS[1], "state", "attempt", "owner"))
+if state ~= "started" or attempt ~= ARGV[3] or owner ~= ARGV[4] then
+	return {0, current[1], current[2]}
+end
+return start(KEYS[1], ARGV[1], ARGV[2], false)
+`)
+
+// heartbeatScript refreshes the heartbeat of the started record at KEYS[1]
+// owned by ARGV[1]. It replies 1 on success, 0 if the record belongs to
+// someone else and -1 if it doesn't exist. ARGV: owner, now.
+var heartbeatScript = redis.NewScript(`
+local kind = redis.call("TYPE", KEYS[1]).ok
+if kind == "none" then
+	return -1
+end
+if kind ~= "hash" then
+	return 0
+end
+
+local state, owner = unpack(redis.call("HMGET", KEYS[1], "state", "owner"))
+if state ~= "started" or owner ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "heartbeat_at", ARGV[2])
+return 1
+`)
+
+// setScript stores the response ARGV[1] at KEYS[1] as a completed record
+// for ARGV[3] ms, whatever the current record. ARGV: response, now, ttl in ms.
+var setScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "hash" then
+	redis.call("DEL", KEYS[1])
+	redis.call("HSET", KEYS[1], "attempt", 1, "token", 0, "started_at", ARGV[2])
+end
+redis.call("HSET", KEYS[1], "state", "completed", "response", ARGV[1], "updated_at", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// ownedRecord is shared by the scripts changing the record of an attempt.
+// owned replies 1 if the record at key is attempt owned by owner and in one
+// of the given states, 0 if it isn't and -1 if it doesn't exist.
+const ownedRecord = `
+local function owned(key, attempt, owner, states)
+	local kind = redis.call("TYPE", key).ok
+	if kind == "none" then
+		return -1
+	end
+	if kind ~= "hash" then
+		return 0
+	end
+
+	local state, current, currentOwner = unpack(redis.call("HMGET", key, "state", "attempt", "owner"))
+	if not states[state] or current ~= attempt or currentOwner ~= owner then
+		return 0
+	end
+	return 1
+end
+`
+
+// completeScript stores the response ARGV[1] in the record at KEYS[1] and
+// marks it completed for ARGV[3] ms if it is still the attempt ARGV[4] owned
+// by ARGV[5], started or completed. It replies like owned.
+// ARGV: response, now, ttl in ms, attempt, owner.
+var completeScript = redis.NewScript(ownedRecord + `
+local n = owned(KEYS[1], ARGV[4], ARGV[5], {started = true, completed = true})
+if n ~= 1 then
+	return n
+end
+redis.call("HSET", KEYS[1], "state", "completed", "response", ARGV[1], "updated_at", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// failScript marks the record at KEYS[1] failed if it is still the started
+// attempt ARGV[2] owned by ARGV[3]. It replies like owned.
+// ARGV: now, attempt, owner.
+var failScript = redis.NewScript(ownedRecord + `
+local n = owned(KEYS[1], ARGV[2], ARGV[3], {started = true})
+if n ~= 1 then
+	return n
+end
+redis.call("HSET", KEYS[1], "state", "failed", "updated_at", ARGV[1])
+return 1
+`)
+
+// lockScript takes the next fencing token from the counter KEYS[2] and uses
+// it to acquire the lock KEYS[1]. It replies the token, or 0 if the lock is
+// held. ARGV: lock TTL in ms, counter TTL in ms.
+var lockScript = redis.NewScript(`
+local token = redis.call("INCR", KEYS[2])
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+if not redis.call("SET", KEYS[1], token, "NX", "PX", ARGV[1]) then
+	return 0
+end
+return token
+`)
+
+// unlockScript deletes a lock only if it still holds the caller's token
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
@@ -1,12 +1,17 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
@@ -112,6 +117,360 @@ func TestRedisStore_LockAutoExpires(t *testing.T) {
 	unlock2()
 }
 
+func TestRedisStore_IncrAttempt(t *testing.T) {
+	store, mr := setupTestRedis(t)
+
+	n, err := store.IncrAttempt("test-key", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = store.IncrAttempt("test-key", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	mr.FastForward(2 * time.Second)
+
+	n, err = store.IncrAttempt("test-key", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestRedisStore_RecordTTLs(t *testing.T) {
+	store, mr := setupTestRedis(t)
+	owner := idempotency.DefaultOwner()
+	other := idempotency.Owner{Instance: "other", PID: 42}
+
+	// A failed record keeps the lease
+	first, _, err := store.Begin("test-key", owner, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, store.Fail("test-key", first))
+	assert.Equal(t, time.Minute, mr.TTL("{test-key}"))
+
+	// A takeover keeps it too
+	rec, started, err := store.Begin("test-key", owner, time.Minute)
+	require.NoError(t, err)
+	require.True(t, started)
+	rec, started, err = store.Takeover("test-key", rec, other)
+	require.NoError(t, err)
+	require.True(t, started)
+	assert.Equal(t, time.Minute, mr.TTL("{test-key}"))
+
+	// The completed record lives for the response TTL
+	require.NoError(t, store.Complete("test-key", rec, &idempotency.CachedResponse{StatusCode: 201}, time.Hour))
+	assert.Equal(t, time.Hour, mr.TTL("{test-key}"))
+}
+
+func TestRedisStore_BeginExpires(t *testing.T) {
+	store, mr := setupTestRedis(t)
+	owner := idempotency.DefaultOwner()
+
+	_, started, err := store.Begin("test-key", owner, 30*time.Second)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	mr.FastForward(31 * time.Second)
+
+	_, started, err = store.Begin("test-key", owner, 30*time.Second)
+	require.NoError(t, err)
+	assert.True(t, started)
+}
+
+func TestRedisStore_FencingTokens(t *testing.T) {
+	store, mr := setupTestRedis(t)
+	owner := idempotency.DefaultOwner()
+
+	rec, _, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), rec.Token)
+
+	require.NoError(t, store.Fail("test-key", rec))
+	rec, _, err = store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), rec.Token)
+
+	rec, _, err = store.Takeover("test-key", rec, owner)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), rec.Token)
+
+	unlock1, token1, err := store.LockFenced("lock-key")
+	require.NoError(t, err)
+
+	// The first lock expires while its holder is paused
+	mr.FastForward(31 * time.Second)
+	unlock2, token2, err := store.LockFenced("lock-key")
+	require.NoError(t, err)
+	assert.Greater(t, token2, token1)
+
+	// The stale holder can't release the new lock
+	unlock1()
+	_, err = store.Lock("lock-key")
+	assert.ErrorIs(t, err, idempotency.ErrRequestInProgress)
+	unlock2()
+}
+
+// countingHook counts the commands a client sends to Redis
+type countingHook struct {
+	count int
+}
+
+func (h *countingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *countingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.count++
+		return next(ctx, cmd)
+	}
+}
+
+func (h *countingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.count++
+		return next(ctx, cmds)
+	}
+}
+
+func TestRedisStore_SingleRoundTrips(t *testing.T) {
+	store, _ := setupTestRedis(t)
+	hook := &countingHook{}
+	store.client.AddHook(hook)
+	owner := idempotency.DefaultOwner()
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+
+	// Load the scripts
+	rec, _, err := store.Begin("warmup", owner, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, store.Complete("warmup", rec, response, time.Hour))
+
+	hook.count = 0
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+	assert.Equal(t, 1, hook.count)
+
+	hook.count = 0
+	require.NoError(t, store.Complete("test-key", rec, response, time.Hour))
+	assert.Equal(t, 1, hook.count)
+
+	// Replays come back with the first call
+	hook.count = 0
+	rec, started, err = store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, response.Body, rec.Response.Body)
+	assert.Equal(t, 1, hook.count)
+}
+
+func TestRedisStore_ReadsJSONResponses(t *testing.T) {
+	store, mr := setupTestRedis(t)
+
+	// Responses stored as JSON before codecs existed
+	mr.HSet("{test-key}", "state", "completed", "attempt", "1", "token", "1",
+		"response", `{"status_code":200,"headers":{"Content-Type":["application/json"]},"body":"b2s=","timestamp":"2024-01-01T00:00:00Z"}`)
+
+	cached, err := store.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ok"), cached.Body)
+	assert.Equal(t, "application/json", cached.Headers.Get("Content-Type"))
+
+	// New writes use the binary codec, JSON can still be chosen
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+	require.NoError(t, store.Set("binary-key", response, time.Hour))
+	assert.Equal(t, binaryMagic, mr.HGet("{binary-key}", "response")[0])
+
+	jsonStore := NewRedisStore(store.client, WithCodec(JSONCodec{}))
+	require.NoError(t, jsonStore.Set("json-key", response, time.Hour))
+	assert.Equal(t, byte('{'), mr.HGet("{json-key}", "response")[0])
+
+	cached, err = store.Get("json-key")
+	require.NoError(t, err)
+	assert.Equal(t, response.Body, cached.Body)
+}
+
+func TestRedisStore_ReadsLegacyKeys(t *testing.T) {
+	current, mr := setupTestRedis(t)
+	store := NewRedisStore(current.client, WithLegacyKeys(time.Now().Add(time.Hour)))
+	owner := idempotency.DefaultOwner()
+
+	// Written under untagged keys, as a bare response and as a record hash
+	mr.Set("plain-key", `{"status_code":201,"body":"b2s=","timestamp":"2024-01-01T00:00:00Z"}`)
+	mr.SetTTL("plain-key", time.Hour)
+	mr.HSet("hash-key", "state", "completed", "attempt", "1", "token", "1",
+		"response", `{"status_code":202,"body":"b2s=","timestamp":"2024-01-01T00:00:00Z"}`)
+	mr.Set("other-key", "not a record")
+
+	cached, err := store.Get("plain-key")
+	require.NoError(t, err)
+	assert.Equal(t, 201, cached.StatusCode)
+
+	rec, started, err := store.Begin("plain-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateCompleted, rec.State)
+	assert.Equal(t, []byte("ok"), rec.Response.Body)
+
+	// The legacy record was copied to the current layout with its TTL
+	assert.Equal(t, "completed", mr.HGet("{plain-key}", "state"))
+	assert.Equal(t, time.Hour, mr.TTL("{plain-key}"))
+
+	rec, started, err = store.Begin("hash-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, 202, rec.Response.StatusCode)
+
+	// Values that aren't records are ignored
+	_, started, err = store.Begin("other-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	// Without the fallback, or once it ended, legacy records aren't seen
+	mr.Set("new-key", `{"status_code":201,"body":"b2s="}`)
+	_, started, err = current.Begin("new-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	ended := NewRedisStore(current.client, WithLegacyKeys(time.Now().Add(-time.Second)))
+	mr.Set("old-key", `{"status_code":201,"body":"b2s="}`)
+	_, started, err = ended.Begin("old-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	// Legacy keys are read under the prefix, not from other applications
+	prefixed := NewRedisStore(current.client, WithKeyPrefix("app:"), WithLegacyKeys(time.Now().Add(time.Hour)))
+	mr.Set("shared-key", `{"status_code":201,"body":"b2s="}`)
+	_, started, err = prefixed.Begin("shared-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	mr.Set("app:prefixed-key", `{"status_code":203,"body":"b2s="}`)
+	rec, started, err = prefixed.Begin("prefixed-key", owner, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, 203, rec.Response.StatusCode)
+}
+
+func TestRedisStore_Compression(t *testing.T) {
+	_, mr := setupTestRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	store := NewRedisStore(client, WithCompression(GzipCompressor{}, 1024))
+
+	large := &idempotency.CachedResponse{StatusCode: 200, Body: bytes.Repeat([]byte("a"), 4096)}
+	small := &idempotency.CachedResponse{StatusCode: 200, Body: []byte("a")}
+	require.NoError(t, store.Set("large-key", large, time.Hour))
+	require.NoError(t, store.Set("small-key", small, time.Hour))
+
+	assert.Less(t, len(mr.HGet("{large-key}", "response")), 200)
+
+	cached, err := store.Get("large-key")
+	require.NoError(t, err)
+	assert.Equal(t, large.Body, cached.Body)
+	assert.Empty(t, cached.BodyEncoding)
+
+	cached, err = store.Get("small-key")
+	require.NoError(t, err)
+	assert.Equal(t, small.Body, cached.Body)
+}
+
+func TestRedisStore_KeysShareHashTag(t *testing.T) {
+	store, mr := setupTestRedis(t)
+
+	_, _, err := store.Begin("test-key", idempotency.DefaultOwner(), time.Hour)
+	require.NoError(t, err)
+	unlock, err := store.Lock("test-key")
+	require.NoError(t, err)
+	defer unlock()
+
+	assert.True(t, mr.Exists("{test-key}"))
+	assert.True(t, mr.Exists("lock:{test-key}"))
+	assert.True(t, mr.Exists("fence:{test-key}"))
+}
+
+func TestRedisStore_InvalidPrefixes(t *testing.T) {
+	assert.Panics(t, func() { WithKeyPrefix("app:{tenant}:") })
+	for _, prefix := range []string{"", "{lock}:", "fence:", "attempts:"} {
+		assert.Panics(t, func() { WithLockPrefix(prefix) }, "lock prefix %q", prefix)
+	}
+	assert.NotPanics(t, func() { WithLockPrefix("mutex:") })
+}
+
+func TestRedisStore_KeyNamespacing(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		client.Close()
+		mr.Close()
+	})
+
+	owner := idempotency.DefaultOwner()
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+	longKey := strings.Repeat("k", 100)
+
+	v1 := NewRedisStore(client,
+		WithKeyPrefix("app:"),
+		WithLockPrefix("mutex:"),
+		WithHashedKeys(64),
+		WithNamespaceVersion(1),
+	)
+	require.NoError(t, v1.Set("test-key", response, time.Hour))
+	require.NoError(t, v1.Set(longKey, response, time.Hour))
+	unlock, err := v1.Lock("test-key")
+	require.NoError(t, err)
+	defer unlock()
+
+	sum := sha256.Sum256([]byte(longKey))
+	assert.True(t, mr.Exists("app:v1:{test-key}"))
+	assert.True(t, mr.Exists("app:v1:mutex:{test-key}"))
+	assert.True(t, mr.Exists("app:v1:{"+hex.EncodeToString(sum[:])+"}"))
+
+	cached, err := v1.Get(longKey)
+	require.NoError(t, err)
+	assert.Equal(t, response.Body, cached.Body)
+
+	// Bumping the version invalidates all records
+	v2 := NewRedisStore(client, WithKeyPrefix("app:"), WithNamespaceVersion(2))
+	_, err = v2.Get("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+	_, started, err := v2.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, started)
+}
+
+func TestRedisStore_ClusterClient(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{mr.Addr()},
+	})
+	t.Cleanup(func() {
+		client.Close()
+		mr.Close()
+	})
+
+	store := NewRedisStore(client)
+	owner := idempotency.DefaultOwner()
+
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte(`{"id":1}`)}
+	require.NoError(t, store.Complete("test-key", rec, response, time.Hour))
+
+	cached, err := store.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, 201, cached.StatusCode)
+
+	// Multi-key lock script
+	unlock, token, err := store.LockFenced("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), token)
+	unlock()
+}
+
 func TestRedisStore_MultipleKeys(t *testing.T) {
 	store, _ := setupTestRedis(t)
 
@@ -231,6 +590,17 @@ func TestRedisStore_RealRedis(t *testing.T) {
 	assert.Equal(t, response.StatusCode, cached.StatusCode)
 
 	// Cleanup
-	client.Del(ctx, testKey)
+	client.Del(ctx, store.recordKey(testKey))
 	client.Close()
 }
+
+func TestRedisStore_Conformance(t *testing.T) {
+	var mr *miniredis.Miniredis
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		var store *RedisStore
+		store, mr = setupTestRedis(t)
+		return store
+	}, storetest.WithSleep(func(d time.Duration) {
+		mr.FastForward(d)
+	}))
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+// snapshotMagic starts every MemoryStore snapshot
+const snapshotMagic = "IDMS"
+
+// snapshotVersion is the current snapshot format version
+const snapshotVersion byte = 1
+
+// SaveSnapshot writes the unexpired records of the store to path.
+// The file is replaced atomically, so a crash never leaves a partial snapshot.
+//
+// Layout: magic | version | (expiration | record)*, with records encoded
+// by DefaultCodec.
+func (s *MemoryStore) SaveSnapshot(path string) error {
+	now := time.Now()
+
+	data := append([]byte(snapshotMagic), snapshotVersion)
+	for _, sh := range s.shards {
+		for _, e := range sh.unexpired(now) {
+			rec, err := DefaultCodec.Marshal(e.record)
+			if err != nil {
+				return err
+			}
+			data = appendTime(data, e.expiresAt)
+			data = appendBytes(data, rec)
+		}
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// LoadSnapshot adds the unexpired records of the snapshot at path to the
+// store, keeping records the store already has. Records that don't fit in
+// a bounded store are skipped.
+func (s *MemoryStore) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < len(snapshotMagic)+1 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%w: not a snapshot", ErrUnknownFormat)
+	}
+	if version := data[len(snapshotMagic)]; version != snapshotVersion {
+		return fmt.Errorf("%w: snapshot version %d", ErrUnknownFormat, version)
+	}
+
+	now := time.Now()
+	r := &binaryReader{data: data[len(snapshotMagic)+1:]}
+	for len(r.data) > 0 {
+		expiresAt := r.time()
+		encoded := r.bytes()
+		if r.err != nil {
+			return r.err
+		}
+		if !now.Before(expiresAt) {
+			continue
+		}
+
+		rec, err := DefaultCodec.Unmarshal(encoded)
+		if err != nil {
+			return err
+		}
+		s.shard(rec.Key).restore(rec, expiresAt)
+	}
+
+	return nil
+}
+
+// unexpired returns the entries of the shard unexpired at now
+func (sh *memoryShard) unexpired(now time.Time) []entry {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	entries := make([]entry, 0, len(sh.data))
+	for _, e := range sh.data {
+		if now.Before(e.expiresAt) {
+			entries = append(entries, entry{expiry: expiry{key: e.key, expiresAt: e.expiresAt}, record: e.record})
+		}
+	}
+	return entries
+}
+
+// restore stores a record read from a snapshot unless key is already in use
+func (sh *memoryShard) restore(rec *idempotency.Record, expiresAt time.Time) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if e, exists := sh.data[rec.Key]; exists && time.Now().Before(e.expiresAt) {
+		return
+	}
+	if err := sh.admit(rec.Key, responseSize(rec.Response)); err != nil {
+		return
+	}
+	sh.set(rec.Key, rec, expiresAt)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore_SnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.snapshot")
+	owner := idempotency.DefaultOwner()
+
+	store := NewMemoryStore()
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte(`{"id":1}`)}
+	require.NoError(t, store.Set("completed", response, time.Hour))
+	require.NoError(t, store.Set("expired", response, time.Millisecond))
+	_, _, err := store.Begin("started", owner, time.Hour)
+	require.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, store.SaveSnapshot(path))
+
+	// The snapshot replaced its temporary file
+	files, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	restored := NewMemoryStore()
+	require.NoError(t, restored.LoadSnapshot(path))
+	assert.Equal(t, 2, restored.Stats().Entries)
+
+	cached, err := restored.Get("completed")
+	require.NoError(t, err)
+	assert.Equal(t, 201, cached.StatusCode)
+	assert.Equal(t, response.Body, cached.Body)
+
+	rec, started, err := restored.Begin("started", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateStarted, rec.State)
+	assert.True(t, rec.Owner.Equal(owner))
+
+	_, err = restored.Get("expired")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func TestMemoryStore_SnapshotOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.snapshot")
+
+	store := NewMemoryStore(WithSnapshot(path, 0))
+	require.NoError(t, store.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+	require.NoError(t, store.Close())
+
+	restored := NewMemoryStore()
+	require.NoError(t, restored.LoadSnapshot(path))
+	_, err := restored.Get("test-key")
+	assert.NoError(t, err)
+}
+
+func TestMemoryStore_PeriodicSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.snapshot")
+
+	store := NewMemoryStore(WithSnapshot(path, 10*time.Millisecond))
+	t.Cleanup(func() { store.Close() })
+	require.NoError(t, store.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+
+	assert.Eventually(t, func() bool {
+		restored := NewMemoryStore()
+		return restored.LoadSnapshot(path) == nil && restored.Stats().Entries == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryStore_LoadSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	err := store.LoadSnapshot(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	future := filepath.Join(dir, "future")
+	require.NoError(t, os.WriteFile(future, []byte(snapshotMagic+"\x02"), 0o600))
+	assert.ErrorIs(t, store.LoadSnapshot(future), ErrUnknownFormat)
+
+	truncated := filepath.Join(dir, "truncated")
+	require.NoError(t, os.WriteFile(truncated, []byte(snapshotMagic+"\x01\x02\x10"), 0o600))
+	assert.Error(t, store.LoadSnapshot(truncated))
+}
@@ -0,0 +1,417 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+const (
+	// DefaultTableName is the default table of SQLStore records
+	DefaultTableName = "idempotency_records"
+
+	// sqlLockLease is how long a lock taken with SQLStore.Lock is held at most
+	sqlLockLease = 30 * time.Second
+	// maxSQLRetries bounds the retries of a record update losing a race
+	maxSQLRetries = 16
+)
+
+// recordColumns are the columns of a record row, in the order they are written
+var recordColumns = []string{"id", "state", "attempt", "token", "version", "owner",
+	"started_at", "heartbeat_at", "updated_at", "expires_at", "response"}
+
+// SQLStore is a database/sql-backed implementation of Store. Create its
+// tables with Migrate.
+//
+// Every update is a compare-and-swap on a row version, so it works the same
+// on all dialects and inside a transaction of the application; see CompleteTx.
+// Expired rows are ignored and overwritten; DeleteExpired removes them.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	ctx     context.Context
+}
+
+// sqlExecutor is implemented by *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlRow is a record row as read from the database
+type sqlRow struct {
+	record    *idempotency.Record
+	version   int64
+	expiresAt time.Time
+}
+
+// NewSQLStore creates a store keeping records in db, using the SQL flavor of dialect
+func NewSQLStore(db *sql.DB, dialect Dialect, opts ...SQLOption) *SQLStore {
+	s := &SQLStore{
+		db:      db,
+		dialect: dialect,
+		table:   DefaultTableName,
+		ctx:     context.Background(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Get retrieves a cached response
+func (s *SQLStore) Get(key string) (*idempotency.CachedResponse, error) {
+	row, err := s.load(s.ctx, s.db, key, false)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil || !time.Now().Before(row.expiresAt) || row.record.State != idempotency.StateCompleted {
+		return nil, idempotency.ErrNotFound
+	}
+
+	return row.record.Response, nil
+}
+
+// Set stores a response with TTL
+func (s *SQLStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
+	return s.update(s.ctx, s.db, key, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		now := time.Now()
+		return &idempotency.Record{
+			Key:       key,
+			State:     idempotency.StateCompleted,
+			Response:  response,
+			StartedAt: now,
+			UpdatedAt: now,
+		}, now.Add(ttl), nil
+	})
+}
+
+// Begin creates a started record for key, or returns the current one
+func (s *SQLStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	var rec *idempotency.Record
+	var started bool
+	err := s.update(s.ctx, s.db, key, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		if current != nil && current.State != idempotency.StateFailed {
+			rec, started = current, false
+			return nil, expiresAt, nil
+		}
+
+		rec, started = newStartedRecord(key, owner, current), true
+		return rec, time.Now().Add(ttl), nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return rec, started, nil
+}
+
+// Heartbeat refreshes the heartbeat of a started record owned by owner
+func (s *SQLStore) Heartbeat(key string, owner idempotency.Owner) error {
+	return s.update(s.ctx, s.db, key, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		if current == nil {
+			return nil, expiresAt, idempotency.ErrNotFound
+		}
+		if current.State != idempotency.StateStarted || !current.Owner.Equal(owner) {
+			return nil, expiresAt, idempotency.ErrNotOwner
+		}
+
+		current.HeartbeatAt = time.Now()
+		return current, expiresAt, nil
+	})
+}
+
+// Takeover replaces a stale started record with a new attempt owned by owner
+func (s *SQLStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	var rec *idempotency.Record
+	var started bool
+	err := s.update(s.ctx, s.db, key, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		if current == nil {
+			return nil, expiresAt, idempotency.ErrNotFound
+		}
+		if !sameAttempt(current, stale) {
+			rec, started = current, false
+			return nil, expiresAt, nil
+		}
+
+		rec, started = newStartedRecord(key, owner, current), true
+		return rec, expiresAt, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return rec, started, nil
+}
+
+// Complete stores the response and marks the started record rec completed
+func (s *SQLStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	return s.update(s.ctx, s.db, key, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		if current == nil {
+			return nil, expiresAt, idempotency.ErrNotFound
+		}
+		if !completableBy(current, rec) {
+			return nil, expiresAt, idempotency.ErrNotOwner
+		}
+		return completeRecord(current, response, ttl)
+	})
+}
+
+// CompleteTx completes the record of the request handled under ctx within
+// tx, so it is committed or rolled back together with the application's own
+// writes. It fails with idempotency.ErrNotOwner if the record was taken over
+// by another attempt, in which case tx should be rolled back.
+//
+// The middleware completes the record again with the recorded response once
+// the handler returns.
+//
+// On Postgres tx must run under READ COMMITTED, the default: heartbeats keep
+// updating the record while the handler runs, and under REPEATABLE READ or
+// SERIALIZABLE reading a record updated after the transaction's snapshot
+// fails with a serialization error, aborting tx.
+func (s *SQLStore) CompleteTx(ctx context.Context, tx *sql.Tx, response *idempotency.CachedResponse, ttl time.Duration) error {
+	info, ok := idempotency.FromContext(ctx)
+	if !ok {
+		return idempotency.ErrNotFound
+	}
+
+	return s.update(ctx, tx, info.StoreKey, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		if current == nil {
+			return nil, expiresAt, idempotency.ErrNotFound
+		}
+		if current.State != idempotency.StateStarted || current.Token != info.FencingToken {
+			return nil, expiresAt, idempotency.ErrNotOwner
+		}
+		return completeRecord(current, response, ttl)
+	})
+}
+
+// Fail marks the started record rec failed so the next Begin re-runs the request
+func (s *SQLStore) Fail(key string, rec *idempotency.Record) error {
+	return s.update(s.ctx, s.db, key, func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error) {
+		if current == nil {
+			return nil, expiresAt, idempotency.ErrNotFound
+		}
+		if !sameAttempt(current, rec) {
+			return nil, expiresAt, idempotency.ErrNotOwner
+		}
+
+		current.State = idempotency.StateFailed
+		current.UpdatedAt = time.Now()
+		return current, expiresAt, nil
+	})
+}
+
+// Lock acquires a lock for the given key, held for at most 30 seconds
+func (s *SQLStore) Lock(key string) (func(), error) {
+	locks := s.table + "_locks"
+	id := keyHash(key)
+	now := time.Now()
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	token := int64(binary.BigEndian.Uint64(b[:]) >> 1)
+
+	// Break a lock whose holder didn't release it in time
+	if _, err := s.db.ExecContext(s.ctx, s.dialect.rebind(fmt.Sprintf(
+		"DELETE FROM %s WHERE id = ? AND expires_at <= ?", locks)), id, now.UnixNano()); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.ExecContext(s.ctx, s.dialect.rebind(s.dialect.insertIfAbsent(locks, "id", "token", "expires_at")),
+		id, token, now.Add(sqlLockLease).UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, idempotency.ErrRequestInProgress
+	}
+
+	unlock := func() {
+		s.db.ExecContext(s.ctx, s.dialect.rebind(fmt.Sprintf(
+			"DELETE FROM %s WHERE id = ? AND token = ?", locks)), id, token)
+	}
+	return unlock, nil
+}
+
+// DeleteExpired removes expired records and locks, returning the number of
+// records removed. Run it periodically to keep the table small.
+func (s *SQLStore) DeleteExpired(ctx context.Context) (int64, error) {
+	now := time.Now().UnixNano()
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(fmt.Sprintf(
+		"DELETE FROM %s_locks WHERE expires_at <= ?", s.table)), now); err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(fmt.Sprintf(
+		"DELETE FROM %s WHERE expires_at <= ?", s.table)), now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// update applies fn to the unexpired record of key, nil if there is none,
+// and writes the record fn returns unless it is nil. fn is called again if
+// the row changed in the meantime.
+//
+// Within a transaction the row is read with a locking read where the
+// dialect has one, which returns its latest version under MySQL's
+// REPEATABLE READ where a plain read would keep returning the snapshot.
+// Postgres instead fails the locking read with a serialization error if the
+// row changed after the snapshot, so there it only works under READ COMMITTED.
+func (s *SQLStore) update(ctx context.Context, db sqlExecutor, key string,
+	fn func(current *idempotency.Record, expiresAt time.Time) (*idempotency.Record, time.Time, error)) error {
+	_, inTx := db.(*sql.Tx)
+	forUpdate := inTx && s.dialect.forUpdate
+
+	for i := 0; i < maxSQLRetries; i++ {
+		row, err := s.load(ctx, db, key, forUpdate)
+		if err != nil {
+			return err
+		}
+
+		var current *idempotency.Record
+		var expiresAt time.Time
+		if row != nil && time.Now().Before(row.expiresAt) {
+			current, expiresAt = row.record, row.expiresAt
+		}
+
+		next, nextExpiresAt, err := fn(current, expiresAt)
+		if err != nil || next == nil {
+			return err
+		}
+
+		saved, err := s.save(ctx, db, key, row, next, nextExpiresAt)
+		if err != nil || saved {
+			return err
+		}
+	}
+
+	return idempotency.ErrLockFailed
+}
+
+// load reads the row of key, expired or not, or returns nil if there is none.
+// With forUpdate the row is locked until the end of the transaction.
+func (s *SQLStore) load(ctx context.Context, db sqlExecutor, key string, forUpdate bool) (*sqlRow, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", strings.Join(recordColumns[1:], ", "), s.table)
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var (
+		state                                     string
+		owner                                     string
+		startedAt, heartbeatAt, updatedAt, expiry int64
+		response                                  []byte
+		row                                       = &sqlRow{record: &idempotency.Record{Key: key}}
+	)
+	err := db.QueryRowContext(ctx, s.dialect.rebind(query), keyHash(key)).Scan(
+		&state, &row.record.Attempt, &row.record.Token, &row.version, &owner,
+		&startedAt, &heartbeatAt, &updatedAt, &expiry, &response)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	row.record.State = idempotency.RecordState(state)
+	row.record.StartedAt = fromUnixNano(startedAt)
+	row.record.HeartbeatAt = fromUnixNano(heartbeatAt)
+	row.record.UpdatedAt = fromUnixNano(updatedAt)
+	row.expiresAt = fromUnixNano(expiry)
+	if err := json.Unmarshal([]byte(owner), &row.record.Owner); err != nil {
+		return nil, err
+	}
+	if response != nil {
+		completed, err := DefaultCodec.Unmarshal(response)
+		if err != nil {
+			return nil, err
+		}
+		row.record.Response = completed.Response
+	}
+
+	return row, nil
+}
+
+// save writes rec as the row of key if the row is still prev, nil standing
+// for no row, and reports whether it did
+func (s *SQLStore) save(ctx context.Context, db sqlExecutor, key string, prev *sqlRow, rec *idempotency.Record, expiresAt time.Time) (bool, error) {
+	owner, err := json.Marshal(rec.Owner)
+	if err != nil {
+		return false, err
+	}
+
+	var response []byte
+	if rec.Response != nil {
+		if response, err = DefaultCodec.Marshal(&idempotency.Record{
+			Key:      key,
+			State:    idempotency.StateCompleted,
+			Response: rec.Response,
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	version := int64(1)
+	if prev != nil {
+		version = prev.version + 1
+	}
+	values := []interface{}{string(rec.State), rec.Attempt, rec.Token, version, string(owner),
+		unixNano(rec.StartedAt), unixNano(rec.HeartbeatAt), unixNano(rec.UpdatedAt), unixNano(expiresAt), response}
+
+	var res sql.Result
+	if prev == nil {
+		res, err = db.ExecContext(ctx, s.dialect.rebind(s.dialect.insertIfAbsent(s.table, recordColumns...)),
+			append([]interface{}{keyHash(key)}, values...)...)
+	} else {
+		query := fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ? AND version = ?",
+			s.table, strings.Join(recordColumns[1:], " = ?, "))
+		res, err = db.ExecContext(ctx, s.dialect.rebind(query), append(values, keyHash(key), prev.version)...)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// completeRecord completes current with response for ttl
+func completeRecord(current *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) (*idempotency.Record, time.Time, error) {
+	now := time.Now()
+	current.State = idempotency.StateCompleted
+	current.Response = response
+	current.UpdatedAt = now
+
+	return current, now.Add(ttl), nil
+}
+
+// unixNano converts t to Unix nanoseconds, with 0 standing for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
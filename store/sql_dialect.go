@@ -0,0 +1,186 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+// Dialect adapts SQLStore to a database's SQL flavor
+type Dialect struct {
+	name         string
+	numbered     bool
+	insertIgnore bool
+	forUpdate    bool
+}
+
+var (
+	// Postgres is the dialect of PostgreSQL
+	Postgres = Dialect{name: "postgres", numbered: true, forUpdate: true}
+	// MySQL is the dialect of MySQL and MariaDB
+	MySQL = Dialect{name: "mysql", insertIgnore: true, forUpdate: true}
+	// SQLite is the dialect of SQLite 3.24 and later
+	SQLite = Dialect{name: "sqlite"}
+)
+
+// String returns the name of the dialect
+func (d Dialect) String() string {
+	return d.name
+}
+
+// rebind rewrites the ? placeholders of query for the dialect
+func (d Dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// insertIfAbsent returns a statement inserting a row into table unless a
+// row with the same id exists
+func (d Dialect) insertIfAbsent(table string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if d.insertIgnore {
+		return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING", table, strings.Join(columns, ", "), placeholders)
+}
+
+// lockMigrations keeps other instances from migrating table until the
+// returned function is called with the outcome of the migration: an
+// advisory lock on Postgres and MySQL, a write transaction on SQLite.
+// The lock belongs to conn, which must run the migration.
+func (d Dialect) lockMigrations(ctx context.Context, conn *sql.Conn, table string) (func(err error) error, error) {
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	id := h.Sum64()
+
+	switch d.name {
+	case Postgres.name:
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", int64(id)); err != nil {
+			return nil, err
+		}
+		return func(err error) error {
+			_, unlockErr := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", int64(id))
+			return errors.Join(err, unlockErr)
+		}, nil
+	case MySQL.name:
+		name := fmt.Sprintf("idempotency_migrate_%x", id)
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, -1)", name).Scan(&locked); err != nil {
+			return nil, err
+		}
+		if locked.Int64 != 1 {
+			return nil, fmt.Errorf("migration lock %s not acquired", name)
+		}
+		return func(err error) error {
+			_, unlockErr := conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", name)
+			return errors.Join(err, unlockErr)
+		}, nil
+	default:
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			return nil, err
+		}
+		return func(err error) error {
+			if err != nil {
+				conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK")
+				return err
+			}
+			_, err = conn.ExecContext(ctx, "COMMIT")
+			return err
+		}, nil
+	}
+}
+
+// Migrate creates or upgrades the tables of the store. Applied migrations
+// are recorded in the <table>_schema table; running Migrate again, or from
+// several instances at once, is safe as the instances take turns.
+func (s *SQLStore) Migrate(ctx context.Context) (err error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	unlock, err := s.dialect.lockMigrations(ctx, conn, s.table)
+	if err != nil {
+		return err
+	}
+	defer func() { err = unlock(err) }()
+
+	return s.migrate(ctx, conn)
+}
+
+// migrate applies the pending migrations over conn
+func (s *SQLStore) migrate(ctx context.Context, conn *sql.Conn) error {
+	schemaTable := s.table + "_schema"
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL)", schemaTable)); err != nil {
+		return err
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", schemaTable)).Scan(&current); err != nil {
+		return err
+	}
+
+	dir := "migrations/" + s.dialect.name
+	files, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, file := range files {
+		// Files are named <version>_<description>.sql
+		version, err := strconv.Atoi(strings.SplitN(file.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", file.Name(), err)
+		}
+		if version <= current {
+			continue
+		}
+
+		script, err := migrations.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			return err
+		}
+		for _, stmt := range strings.Split(strings.ReplaceAll(string(script), "{{table}}", s.table), ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %s: %w", file.Name(), err)
+			}
+		}
+
+		if _, err := conn.ExecContext(ctx, s.dialect.rebind(s.dialect.insertIfAbsent(schemaTable, "version", "applied_at")),
+			version, time.Now().UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
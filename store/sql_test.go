@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialects(t *testing.T) {
+	assert.Equal(t, "UPDATE t SET a = $1 WHERE id = $2", Postgres.rebind("UPDATE t SET a = ? WHERE id = ?"))
+	assert.Equal(t, "UPDATE t SET a = ? WHERE id = ?", MySQL.rebind("UPDATE t SET a = ? WHERE id = ?"))
+
+	assert.Equal(t, "INSERT INTO t (id, a) VALUES ($1, $2) ON CONFLICT DO NOTHING", Postgres.rebind(Postgres.insertIfAbsent("t", "id", "a")))
+	assert.Equal(t, "INSERT IGNORE INTO t (id, a) VALUES (?, ?)", MySQL.insertIfAbsent("t", "id", "a"))
+
+	// Every dialect has its migrations
+	for _, dialect := range []Dialect{Postgres, MySQL, SQLite} {
+		files, err := migrations.ReadDir("migrations/" + dialect.String())
+		require.NoError(t, err)
+		assert.NotEmpty(t, files)
+	}
+}
+
+func TestDialects_LockingRead(t *testing.T) {
+	// Postgres needs READ COMMITTED for these, see CompleteTx
+	for dialect, locking := range map[Dialect]bool{Postgres: true, MySQL: true, SQLite: false} {
+		t.Run(dialect.String(), func(t *testing.T) {
+			conn := &recordingConn{}
+			db := sql.OpenDB(conn)
+			defer db.Close()
+			s := NewSQLStore(db, dialect)
+
+			noop := func(*idempotency.Record, time.Time) (*idempotency.Record, time.Time, error) {
+				return nil, time.Time{}, nil
+			}
+
+			require.NoError(t, s.update(context.Background(), db, "test-key", noop))
+			require.Len(t, conn.queries, 1)
+			assert.NotContains(t, conn.queries[0], "FOR UPDATE", "reads outside a transaction don't lock")
+
+			tx, err := db.Begin()
+			require.NoError(t, err)
+			defer tx.Rollback()
+
+			require.NoError(t, s.update(context.Background(), tx, "test-key", noop))
+			require.Len(t, conn.queries, 2)
+			assert.Equal(t, locking, strings.HasSuffix(conn.queries[1], " FOR UPDATE"))
+		})
+	}
+}
+
+// recordingConn is a database/sql driver connection that records the
+// queries it runs and finds no rows
+type recordingConn struct {
+	queries []string
+}
+
+func (c *recordingConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *recordingConn) Driver() driver.Driver                        { return nil }
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return nil }
+
+type recordingStmt struct {
+	conn  *recordingConn
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.conn.queries = append(s.conn.queries, s.query)
+	return driver.RowsAffected(0), nil
+}
+
+func (s *recordingStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.conn.queries = append(s.conn.queries, s.query)
+	return noRows{}, nil
+}
+
+type noRows struct{}
+
+func (noRows) Columns() []string         { return nil }
+func (noRows) Close() error              { return nil }
+func (noRows) Next([]driver.Value) error { return io.EOF }
@@ -0,0 +1,236 @@
+// Package sqlitetest runs the SQLStore tests against SQLite. It is a module
+// of its own, so the SQLite driver isn't a dependency of the library.
+package sqlitetest
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func setupTestSQLStore(t *testing.T, opts ...store.SQLOption) (*store.SQLStore, *sql.DB) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	s := store.NewSQLStore(db, store.SQLite, opts...)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	return s, db
+}
+
+func TestSQLStore_Migrate(t *testing.T) {
+	s, db := setupTestSQLStore(t, store.WithTableName("idem"))
+
+	// Migrating again is a no-op
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var version int
+	require.NoError(t, db.QueryRow("SELECT MAX(version) FROM idem_schema").Scan(&version))
+	assert.Equal(t, 1, version)
+
+	require.NoError(t, s.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM idem").Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestSQLStore_MigrateConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		db, err := sql.Open("sqlite", path)
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = store.NewSQLStore(db, store.SQLite).Migrate(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestSQLStore_SetAndGet(t *testing.T) {
+	s, _ := setupTestSQLStore(t)
+
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte(`{"id":1}`)}
+	require.NoError(t, s.Set("test-key", response, time.Hour))
+
+	cached, err := s.Get("test-key")
+	require.NoError(t, err)
+	assert.Equal(t, 201, cached.StatusCode)
+	assert.Equal(t, response.Body, cached.Body)
+
+	_, err = s.Get("nonexistent")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func TestSQLStore_Expiration(t *testing.T) {
+	s, _ := setupTestSQLStore(t)
+	owner := idempotency.DefaultOwner()
+
+	require.NoError(t, s.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, 50*time.Millisecond))
+	time.Sleep(60 * time.Millisecond)
+
+	_, err := s.Get("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+
+	// An expired row is overwritten by a new attempt
+	rec, started, err := s.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, started)
+	assert.Equal(t, 1, rec.Attempt)
+
+	require.NoError(t, s.Set("other-key", &idempotency.CachedResponse{StatusCode: 200}, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	n, err := s.DeleteExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestSQLStore_ConcurrentBegin(t *testing.T) {
+	s, _ := setupTestSQLStore(t)
+
+	var wg sync.WaitGroup
+	var startedCount atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, started, err := s.Begin("test-key", idempotency.DefaultOwner(), time.Hour)
+			assert.NoError(t, err)
+			if started {
+				startedCount.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), startedCount.Load())
+}
+
+func TestSQLStore_Lock(t *testing.T) {
+	s, _ := setupTestSQLStore(t)
+
+	unlock, err := s.Lock("test-key")
+	require.NoError(t, err)
+
+	_, err = s.Lock("test-key")
+	assert.ErrorIs(t, err, idempotency.ErrRequestInProgress)
+
+	unlock()
+	unlock, err = s.Lock("test-key")
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestSQLStore_CompleteTx(t *testing.T) {
+	s, db := setupTestSQLStore(t)
+	_, err := db.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY)")
+	require.NoError(t, err)
+	response := &idempotency.CachedResponse{StatusCode: 201, Body: []byte(`{"order":1}`)}
+
+	serveSQLHandler(t, s, func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		info, _ := idempotency.FromContext(ctx)
+
+		// A rolled back transaction leaves the record started
+		tx, err := db.BeginTx(ctx, nil)
+		require.NoError(t, err)
+		_, err = tx.ExecContext(ctx, "INSERT INTO orders (id) VALUES (1)")
+		require.NoError(t, err)
+		require.NoError(t, s.CompleteTx(ctx, tx, response, time.Hour))
+		require.NoError(t, tx.Rollback())
+
+		_, err = s.Get(info.StoreKey)
+		assert.ErrorIs(t, err, idempotency.ErrNotFound)
+
+		// A committed one completes it along with the order
+		tx, err = db.BeginTx(ctx, nil)
+		require.NoError(t, err)
+		_, err = tx.ExecContext(ctx, "INSERT INTO orders (id) VALUES (1)")
+		require.NoError(t, err)
+		require.NoError(t, s.CompleteTx(ctx, tx, response, time.Hour))
+		require.NoError(t, tx.Commit())
+
+		cached, err := s.Get(info.StoreKey)
+		require.NoError(t, err)
+		assert.Equal(t, response.Body, cached.Body)
+
+		w.WriteHeader(response.StatusCode)
+		w.Write(response.Body)
+	})
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestSQLStore_CompleteTxFenced(t *testing.T) {
+	s, db := setupTestSQLStore(t)
+
+	serveSQLHandler(t, s, func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		info, _ := idempotency.FromContext(ctx)
+
+		// Another process takes the record over meanwhile
+		current, _, err := s.Begin(info.StoreKey, info.Owner, time.Hour)
+		require.NoError(t, err)
+		_, started, err := s.Takeover(info.StoreKey, current, idempotency.Owner{Instance: "other", PID: 1})
+		require.NoError(t, err)
+		require.True(t, started)
+
+		tx, err := db.BeginTx(ctx, nil)
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		err = s.CompleteTx(ctx, tx, &idempotency.CachedResponse{StatusCode: 201}, time.Hour)
+		assert.ErrorIs(t, err, idempotency.ErrNotOwner)
+	})
+
+	// Outside of a request there is no record to complete
+	err := s.CompleteTx(context.Background(), nil, &idempotency.CachedResponse{}, time.Hour)
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+// serveSQLHandler serves one idempotent request with handler behind the middleware
+func serveSQLHandler(t *testing.T, s *store.SQLStore, handler http.HandlerFunc) {
+	called := false
+	h := idempotency.Middleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		handler(w, r)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req.Header.Set("Idempotency-Key", "test-key")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.True(t, called)
+}
+
+func TestSQLStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		s, _ := setupTestSQLStore(t)
+		return s
+	})
+}
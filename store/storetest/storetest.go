@@ -0,0 +1,307 @@
+// Package storetest checks that an idempotency.Store behaves the way the
+// middleware expects. Backends outside this module can run it from their
+// own tests:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) idempotency.Store {
+//			return NewMyStore(...)
+//		})
+//	}
+package storetest
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new, empty store for one test
+type Factory func(t *testing.T) idempotency.Store
+
+// Option is a functional option for configuring the suite
+type Option func(*suite)
+
+// WithSleep sets how the suite waits for records to expire, time.Sleep by
+// default. Stores whose backend keeps its own clock, like miniredis, pass
+// a function advancing that clock instead.
+func WithSleep(sleep func(d time.Duration)) Option {
+	return func(s *suite) {
+		s.sleep = sleep
+	}
+}
+
+type suite struct {
+	newStore Factory
+	sleep    func(d time.Duration)
+}
+
+// Run runs the conformance suite against stores created by newStore.
+// Stores that also implement idempotency.RecordStore are checked for the
+// record lifecycle as well.
+func Run(t *testing.T, newStore Factory, opts ...Option) {
+	s := &suite{newStore: newStore, sleep: time.Sleep}
+	for _, opt := range opts {
+		opt(s)
+	}
+	_, records := newStore(t).(idempotency.RecordStore)
+
+	t.Run("GetNotFound", s.testGetNotFound)
+	t.Run("RoundTrip", s.testRoundTrip)
+	t.Run("Overwrite", s.testOverwrite)
+	t.Run("Expiry", s.testExpiry)
+	t.Run("LockExclusive", s.testLockExclusive)
+	t.Run("Unlock", s.testUnlock)
+
+	if records {
+		t.Run("BeginCompleteFail", s.testBeginCompleteFail)
+		t.Run("HeartbeatAndTakeover", s.testHeartbeatAndTakeover)
+		t.Run("TakenOverAttempt", s.testTakenOverAttempt)
+	}
+}
+
+func (s *suite) testGetNotFound(t *testing.T) {
+	store := s.newStore(t)
+
+	_, err := store.Get("missing")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func (s *suite) testRoundTrip(t *testing.T) {
+	store := s.newStore(t)
+
+	body := make([]byte, 256)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	response := &idempotency.CachedResponse{
+		StatusCode: http.StatusCreated,
+		Headers: http.Header{
+			"Content-Type": []string{"application/octet-stream"},
+			"Set-Cookie":   []string{"a=1", "b=2"},
+		},
+		Body:      body,
+		Timestamp: time.Now(),
+	}
+	require.NoError(t, store.Set("key", response, time.Hour))
+
+	cached, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCode, cached.StatusCode)
+	assert.Equal(t, response.Headers, cached.Headers)
+	assert.Equal(t, response.Body, cached.Body)
+	assert.True(t, response.Timestamp.Equal(cached.Timestamp), "timestamp %v, want %v", cached.Timestamp, response.Timestamp)
+
+	// Keys are independent
+	_, err = store.Get("key2")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+}
+
+func (s *suite) testOverwrite(t *testing.T) {
+	store := s.newStore(t)
+
+	require.NoError(t, store.Set("key", &idempotency.CachedResponse{StatusCode: http.StatusOK}, time.Hour))
+	require.NoError(t, store.Set("key", &idempotency.CachedResponse{StatusCode: http.StatusAccepted}, time.Hour))
+
+	cached, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, cached.StatusCode)
+}
+
+func (s *suite) testExpiry(t *testing.T) {
+	store := s.newStore(t)
+
+	require.NoError(t, store.Set("short", &idempotency.CachedResponse{StatusCode: http.StatusOK}, 100*time.Millisecond))
+	require.NoError(t, store.Set("long", &idempotency.CachedResponse{StatusCode: http.StatusOK}, time.Hour))
+
+	_, err := store.Get("short")
+	require.NoError(t, err)
+
+	s.sleep(150 * time.Millisecond)
+
+	_, err = store.Get("short")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+	_, err = store.Get("long")
+	assert.NoError(t, err)
+}
+
+func (s *suite) testLockExclusive(t *testing.T) {
+	store := s.newStore(t)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		holders  int
+		maxHeld  int
+		acquired int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			unlock, err := store.Lock("key")
+			if err != nil {
+				assert.True(t, errors.Is(err, idempotency.ErrRequestInProgress), "unexpected error: %v", err)
+				return
+			}
+
+			mu.Lock()
+			holders++
+			acquired++
+			if holders > maxHeld {
+				maxHeld = holders
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, maxHeld, "lock held by several callers at once")
+	assert.GreaterOrEqual(t, acquired, 1)
+
+	// The lock is free again once every holder released it
+	unlock, err := store.Lock("key")
+	require.NoError(t, err)
+	unlock()
+}
+
+func (s *suite) testUnlock(t *testing.T) {
+	store := s.newStore(t)
+
+	unlock, err := store.Lock("key")
+	require.NoError(t, err)
+
+	// Other keys aren't locked
+	other, err := store.Lock("other")
+	require.NoError(t, err)
+	other()
+
+	_, err = store.Lock("key")
+	assert.ErrorIs(t, err, idempotency.ErrRequestInProgress)
+
+	unlock()
+
+	unlock, err = store.Lock("key")
+	require.NoError(t, err)
+	unlock()
+}
+
+func (s *suite) testBeginCompleteFail(t *testing.T) {
+	store := s.newStore(t).(idempotency.RecordStore)
+	owner := idempotency.DefaultOwner()
+
+	first, started, err := store.Begin("key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+	assert.Equal(t, idempotency.StateStarted, first.State)
+	assert.Equal(t, 1, first.Attempt)
+
+	// A second request finds the first one running
+	rec, started, err := store.Begin("key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateStarted, rec.State)
+	assert.True(t, rec.Owner.Equal(owner))
+
+	// A failed attempt is retried with a new fencing token
+	require.NoError(t, store.Fail("key", first))
+	second, started, err := store.Begin("key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+	assert.Equal(t, 2, second.Attempt)
+	assert.Greater(t, second.Token, first.Token)
+
+	response := &idempotency.CachedResponse{StatusCode: http.StatusCreated, Body: []byte("done")}
+	require.NoError(t, store.Complete("key", second, response, time.Hour))
+	rec, started, err = store.Begin("key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateCompleted, rec.State)
+	require.NotNil(t, rec.Response)
+	assert.Equal(t, http.StatusCreated, rec.Response.StatusCode)
+	assert.Equal(t, []byte("done"), rec.Response.Body)
+
+	// Completing the same attempt again succeeds, failing it changes nothing
+	require.NoError(t, store.Complete("key", second, response, time.Hour))
+	assert.ErrorIs(t, store.Fail("key", second), idempotency.ErrNotOwner)
+	rec, _, err = store.Begin("key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, idempotency.StateCompleted, rec.State)
+
+	assert.ErrorIs(t, store.Fail("missing", first), idempotency.ErrNotFound)
+}
+
+func (s *suite) testHeartbeatAndTakeover(t *testing.T) {
+	store := s.newStore(t).(idempotency.RecordStore)
+	owner := idempotency.DefaultOwner()
+	other := idempotency.Owner{Instance: "storetest-other", PID: 1}
+
+	assert.ErrorIs(t, store.Heartbeat("key", owner), idempotency.ErrNotFound)
+
+	stale, started, err := store.Begin("key", other, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	require.NoError(t, store.Heartbeat("key", other))
+	assert.ErrorIs(t, store.Heartbeat("key", owner), idempotency.ErrNotOwner)
+
+	rec, started, err := store.Takeover("key", stale, owner)
+	require.NoError(t, err)
+	require.True(t, started)
+	assert.True(t, rec.Owner.Equal(owner))
+	assert.Equal(t, stale.Attempt+1, rec.Attempt)
+	assert.Greater(t, rec.Token, stale.Token)
+
+	// Only one takeover of the same attempt wins
+	rec, started, err = store.Takeover("key", stale, other)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.True(t, rec.Owner.Equal(owner))
+
+	// The previous owner lost the record
+	assert.ErrorIs(t, store.Heartbeat("key", other), idempotency.ErrNotOwner)
+}
+
+func (s *suite) testTakenOverAttempt(t *testing.T) {
+	store := s.newStore(t).(idempotency.RecordStore)
+	owner := idempotency.DefaultOwner()
+	other := idempotency.Owner{Instance: "storetest-other", PID: 1}
+
+	stale, started, err := store.Begin("key", other, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+	rec, started, err := store.Takeover("key", stale, owner)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	// The attempt that was taken over can neither release nor complete the key
+	assert.ErrorIs(t, store.Fail("key", stale), idempotency.ErrNotOwner)
+	assert.ErrorIs(t, store.Complete("key", stale, &idempotency.CachedResponse{StatusCode: http.StatusOK}, time.Hour), idempotency.ErrNotOwner)
+
+	current, started, err := store.Begin("key", other, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateStarted, current.State)
+	assert.True(t, current.Owner.Equal(owner))
+
+	require.NoError(t, store.Complete("key", rec, &idempotency.CachedResponse{StatusCode: http.StatusCreated}, time.Hour))
+	assert.ErrorIs(t, store.Complete("key", stale, &idempotency.CachedResponse{StatusCode: http.StatusOK}, time.Hour), idempotency.ErrNotOwner)
+
+	current, _, err = store.Begin("key", other, time.Hour)
+	require.NoError(t, err)
+	require.NotNil(t, current.Response)
+	assert.Equal(t, http.StatusCreated, current.Response.StatusCode)
+}
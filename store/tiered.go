@@ -0,0 +1,189 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+)
+
+const (
+	// DefaultL1Size is the default number of records kept by a TieredStore's L1
+	DefaultL1Size = 10000
+	// DefaultL1TTL is the default longest time a TieredStore's L1 keeps a record
+	DefaultL1TTL = time.Minute
+)
+
+// TieredStore layers a bounded in-process cache (L1) over a backing store (L2).
+// Only completed records are kept in L1, since they don't change until they
+// expire. Locks, record transitions and writes always go to L2, so instances
+// sharing L2 still agree on who runs a request.
+//
+// A record read from L2 is kept in L1 for at most the L1 TTL, so a replay may
+// be served up to that long after the record expired in L2.
+type TieredStore struct {
+	l2      idempotency.Store
+	records idempotency.RecordStore
+
+	mu      sync.Mutex
+	l1      map[string]*list.Element
+	lru     *list.List
+	maxSize int
+	ttl     time.Duration
+}
+
+type tieredEntry struct {
+	key       string
+	record    *idempotency.Record
+	expiresAt time.Time
+}
+
+// NewTieredStore creates a store caching completed records of l2 in memory
+func NewTieredStore(l2 idempotency.Store, opts ...TieredOption) *TieredStore {
+	s := &TieredStore{
+		l2:      l2,
+		records: idempotency.AsRecordStore(l2),
+		l1:      make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: DefaultL1Size,
+		ttl:     DefaultL1TTL,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Get retrieves a cached response from L1, or from L2 on a miss
+func (s *TieredStore) Get(key string) (*idempotency.CachedResponse, error) {
+	if rec := s.load(key); rec != nil {
+		return rec.Response, nil
+	}
+
+	response, err := s.l2.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	s.store(&idempotency.Record{Key: key, State: idempotency.StateCompleted, Response: response}, s.ttl)
+
+	return response, nil
+}
+
+// Set stores a response in L2, then in L1
+func (s *TieredStore) Set(key string, response *idempotency.CachedResponse, ttl time.Duration) error {
+	if err := s.l2.Set(key, response, ttl); err != nil {
+		return err
+	}
+	s.store(&idempotency.Record{Key: key, State: idempotency.StateCompleted, Response: response}, ttl)
+
+	return nil
+}
+
+// Lock acquires a lock from L2
+func (s *TieredStore) Lock(key string) (func(), error) {
+	return s.l2.Lock(key)
+}
+
+// Begin returns a completed record from L1, or starts a record in L2
+func (s *TieredStore) Begin(key string, owner idempotency.Owner, ttl time.Duration) (*idempotency.Record, bool, error) {
+	if rec := s.load(key); rec != nil {
+		return rec, false, nil
+	}
+
+	rec, started, err := s.records.Begin(key, owner, ttl)
+	if err != nil {
+		return nil, false, err
+	}
+	if !started && rec.State == idempotency.StateCompleted && rec.Response != nil {
+		s.store(rec, s.ttl)
+	}
+
+	return rec, started, nil
+}
+
+// Heartbeat refreshes a record in L2
+func (s *TieredStore) Heartbeat(key string, owner idempotency.Owner) error {
+	return s.records.Heartbeat(key, owner)
+}
+
+// Takeover takes over a record in L2
+func (s *TieredStore) Takeover(key string, stale *idempotency.Record, owner idempotency.Owner) (*idempotency.Record, bool, error) {
+	return s.records.Takeover(key, stale, owner)
+}
+
+// Complete completes the record in L2, then keeps it in L1
+func (s *TieredStore) Complete(key string, rec *idempotency.Record, response *idempotency.CachedResponse, ttl time.Duration) error {
+	if err := s.records.Complete(key, rec, response, ttl); err != nil {
+		return err
+	}
+	s.store(&idempotency.Record{Key: key, State: idempotency.StateCompleted, Response: response}, ttl)
+
+	return nil
+}
+
+// Fail fails a record in L2
+func (s *TieredStore) Fail(key string, rec *idempotency.Record) error {
+	s.mu.Lock()
+	s.remove(key)
+	s.mu.Unlock()
+
+	return s.records.Fail(key, rec)
+}
+
+// load returns a copy of the unexpired L1 record of key, or nil
+func (s *TieredStore) load(key string) *idempotency.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.l1[key]
+	if !exists {
+		return nil
+	}
+	e := elem.Value.(*tieredEntry)
+	if time.Now().After(e.expiresAt) {
+		s.remove(key)
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+
+	rec := *e.record
+	return &rec
+}
+
+// store keeps a copy of rec in L1 for ttl, capped at the L1 TTL, evicting
+// the least recently used records beyond the L1 size
+func (s *TieredStore) store(rec *idempotency.Record, ttl time.Duration) {
+	if s.maxSize <= 0 {
+		return
+	}
+	if ttl <= 0 || ttl > s.ttl {
+		ttl = s.ttl
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached := *rec
+	e := &tieredEntry{key: rec.Key, record: &cached, expiresAt: time.Now().Add(ttl)}
+	if elem, exists := s.l1[rec.Key]; exists {
+		elem.Value = e
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.l1[rec.Key] = s.lru.PushFront(e)
+
+	for s.lru.Len() > s.maxSize {
+		s.remove(s.lru.Back().Value.(*tieredEntry).key)
+	}
+}
+
+// remove drops key from L1. The caller must hold s.mu.
+func (s *TieredStore) remove(key string) {
+	if elem, exists := s.l1[key]; exists {
+		s.lru.Remove(elem)
+		delete(s.l1, key)
+	}
+}
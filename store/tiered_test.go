@@ -0,0 +1,129 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AnandSundar/go-idempotency"
+	"github.com/AnandSundar/go-idempotency/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredStore_ServesCompletedFromL1(t *testing.T) {
+	l2, _ := setupTestRedis(t)
+	hook := &countingHook{}
+	l2.client.AddHook(hook)
+	store := NewTieredStore(l2)
+	owner := idempotency.DefaultOwner()
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+	require.NoError(t, store.Complete("test-key", rec, response, time.Hour))
+
+	hook.count = 0
+	for i := 0; i < 3; i++ {
+		rec, started, err := store.Begin("test-key", owner, time.Hour)
+		require.NoError(t, err)
+		assert.False(t, started)
+		assert.Equal(t, idempotency.StateCompleted, rec.State)
+		assert.Equal(t, response.Body, rec.Response.Body)
+
+		cached, err := store.Get("test-key")
+		require.NoError(t, err)
+		assert.Equal(t, response.Body, cached.Body)
+	}
+	assert.Zero(t, hook.count)
+}
+
+func TestTieredStore_FillsL1FromL2(t *testing.T) {
+	l2, _ := setupTestRedis(t)
+	hook := &countingHook{}
+	l2.client.AddHook(hook)
+	owner := idempotency.DefaultOwner()
+	response := &idempotency.CachedResponse{StatusCode: 200, Body: []byte(`{"success":true}`)}
+
+	// Completed by another instance
+	require.NoError(t, l2.Set("test-key", response, time.Hour))
+	store := NewTieredStore(l2)
+
+	// Load the script
+	_, _, err := store.Begin("warmup", owner, time.Hour)
+	require.NoError(t, err)
+
+	hook.count = 0
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, response.Body, rec.Response.Body)
+	assert.Equal(t, 1, hook.count)
+
+	_, _, err = store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, hook.count)
+}
+
+func TestTieredStore_StartedRecordsStayInL2(t *testing.T) {
+	l2 := NewMemoryStore()
+	store := NewTieredStore(l2)
+	owner := idempotency.DefaultOwner()
+
+	first, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	require.True(t, started)
+
+	// A concurrent request elsewhere sees the started record in L2
+	rec, started, err := store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, idempotency.StateStarted, rec.State)
+
+	// Once failed, the request can run again
+	require.NoError(t, store.Fail("test-key", first))
+	_, started, err = store.Begin("test-key", owner, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, started)
+}
+
+func TestTieredStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	l2 := NewMemoryStore()
+	store := NewTieredStore(l2, WithL1Size(2))
+
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.NoError(t, store.Set(key, &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+		if i == 1 {
+			// Keep key-0 recently used
+			assert.NotNil(t, store.load("key-0"))
+		}
+	}
+
+	assert.NotNil(t, store.load("key-0"))
+	assert.Nil(t, store.load("key-1"))
+	assert.NotNil(t, store.load("key-2"))
+
+	// Evicted records are still served from L2
+	cached, err := store.Get("key-1")
+	require.NoError(t, err)
+	assert.Equal(t, 200, cached.StatusCode)
+}
+
+func TestTieredStore_L1TTL(t *testing.T) {
+	l2 := NewMemoryStore()
+	store := NewTieredStore(l2, WithL1TTL(50*time.Millisecond))
+
+	require.NoError(t, store.Set("test-key", &idempotency.CachedResponse{StatusCode: 200}, time.Hour))
+	assert.NotNil(t, store.load("test-key"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(t, store.load("test-key"))
+}
+
+func TestTieredStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		return NewTieredStore(NewMemoryStore())
+	})
+}